@@ -4,6 +4,9 @@ import (
 	"github.com/RcRonco/Hoopoe/rco/dnsproxy"
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -18,6 +21,21 @@ func main() {
 	proxy := dnsproxy.NewDNSProxy(*configPath)
 	log.Info("Configuration loaded successfully")
 
+	// Gracefully stop the proxy on termination signals and reload on SIGHUP
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			log.Infof("Received signal %s", sig)
+			if sig == syscall.SIGHUP {
+				_ = proxy.Reload()
+				continue
+			}
+			proxy.Shutdown()
+			return
+		}
+	}()
+
 	if err := proxy.ListenAndServe(); err != nil {
 		log.Errorf("%d: %s", 25, err.Error())
 	}
@@ -0,0 +1,91 @@
+package dnsproxy
+
+// Aho-Corasick automaton, finds all the patterns contained in the text in single pass
+type ahoCorasick struct {
+	states []acState
+}
+
+type acState struct {
+	next map[byte]int
+	fail int
+	// Closest state on the fail chain that has outputs, -1 when there is none
+	outputLink int
+	outputs    []int
+}
+
+func newAhoCorasick() *ahoCorasick {
+	return &ahoCorasick{states: []acState{{next: make(map[byte]int), outputLink: -1}}}
+}
+
+// Add pattern with its value, build must be called after all patterns are added
+func (ac *ahoCorasick) add(pattern string, value int) {
+	state := 0
+	for i := 0; i < len(pattern); i++ {
+		next, ok := ac.states[state].next[pattern[i]]
+		if !ok {
+			ac.states = append(ac.states, acState{next: make(map[byte]int), outputLink: -1})
+			next = len(ac.states) - 1
+			ac.states[state].next[pattern[i]] = next
+		}
+		state = next
+	}
+	ac.states[state].outputs = append(ac.states[state].outputs, value)
+}
+
+// Build the fail links in BFS order
+func (ac *ahoCorasick) build() {
+	queue := make([]int, 0, len(ac.states))
+	for _, child := range ac.states[0].next {
+		queue = append(queue, child)
+	}
+
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, child := range ac.states[state].next {
+			fail := ac.states[state].fail
+			for {
+				if next, ok := ac.states[fail].next[c]; ok {
+					ac.states[child].fail = next
+					break
+				}
+				if fail == 0 {
+					ac.states[child].fail = 0
+					break
+				}
+				fail = ac.states[fail].fail
+			}
+
+			failState := ac.states[child].fail
+			if len(ac.states[failState].outputs) > 0 {
+				ac.states[child].outputLink = failState
+			} else {
+				ac.states[child].outputLink = ac.states[failState].outputLink
+			}
+			queue = append(queue, child)
+		}
+	}
+}
+
+// Call fn with the value of every pattern found in the text
+func (ac *ahoCorasick) search(text string, fn func(int)) {
+	state := 0
+	for i := 0; i < len(text); i++ {
+		for {
+			if next, ok := ac.states[state].next[text[i]]; ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = ac.states[state].fail
+		}
+
+		for out := state; out > 0; out = ac.states[out].outputLink {
+			for _, value := range ac.states[out].outputs {
+				fn(value)
+			}
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+const (
+	RecordTypeOffset = 3
+	RecordDataOffset = 4
+
+	TTLOption        = "TTL"
+	AnswerDefaultTTL = 60
+	// Max number of local CNAME records followed for single answer
+	MaxCNAMEChain = 8
+)
+
+var (
+	// Record types of the Answer rules
+	AnswerRecordTypes = map[uint16]bool{
+		dns.TypeA:     true,
+		dns.TypeAAAA:  true,
+		dns.TypeCNAME: true,
+		dns.TypeTXT:   true,
+		dns.TypeMX:    true,
+		dns.TypeSRV:   true,
+		dns.TypePTR:   true,
+	}
+
+	// Option keys that end the record data of Answer rules
+	answerOptionKeys = map[string]bool{
+		TTLOption:      true,
+		BlockOption:    true,
+		TypesOption:    true,
+		RegionsOption:  true,
+		ClientsOption:  true,
+		NameOption:     true,
+		ScheduleOption: true,
+		AuditOption:    true,
+	}
+)
+
+/*
+	Local record answered without upstream lookup
+	RULE-TYPE ACTION PATTERN RECORD-TYPE RECORD-DATA OPTIONS
+	Rules with the same action and pattern are the records of the same name.
+*/
+type AnswerRule struct {
+	matcher *MatchingRule
+	group   *answerGroup
+
+	Type   uint16
+	record dns.RR
+}
+
+// Records of the same name, in the config order
+type answerGroup struct {
+	rules []*AnswerRule
+}
+
+func NewAnswerRule(rawRule []string) (error, *AnswerRule) {
+	r := new(AnswerRule)
+	if err := r.Parse(rawRule); err != nil {
+		return err, nil
+	}
+	return nil, r
+}
+
+func (r *AnswerRule) Parse(rawRule []string) error {
+	if len(rawRule) < RecordDataOffset+1 {
+		return fmt.Errorf("answer definition must have at least %d fields", RecordDataOffset+1)
+	}
+
+	// Options are the trailing KEY=VALUE fields, record data can contain = as well
+	end := len(rawRule)
+	for end > RecordDataOffset+1 && isAnswerOption(rawRule[end-1]) {
+		end--
+	}
+	ttl := uint32(AnswerDefaultTTL)
+	options := []string{TypesOption + OptionSeparator + AnyValue}
+	for _, field := range rawRule[end:] {
+		kv := strings.SplitN(field, OptionSeparator, 2)
+		if strings.ToUpper(kv[0]) != TTLOption {
+			options = append(options, field)
+			continue
+		}
+		value, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("option %s must be number of seconds: %s", kv[0], kv[1])
+		}
+		ttl = uint32(value)
+	}
+
+	// Name matching is the same as of the other rules, the rule is applied to any query type
+	err, matcher := NewMatchingRule(append(append([]string(nil), rawRule[:PatternOffset+1]...), options...))
+	if err != nil {
+		return err
+	}
+	r.matcher = matcher
+
+	rrType, ok := dns.StringToType[strings.ToUpper(rawRule[RecordTypeOffset])]
+	if !ok || !AnswerRecordTypes[rrType] {
+		return fmt.Errorf("answer record type %s not supported", rawRule[RecordTypeOffset])
+	}
+	r.Type = rrType
+
+	// Record is parsed with root owner, the owner is the query name when answering
+	data := strings.Join(rawRule[RecordDataOffset:end], " ")
+	record, err := dns.NewRR(fmt.Sprintf(". %d IN %s %s", ttl, dns.TypeToString[rrType], data))
+	if err != nil || record == nil {
+		return fmt.Errorf("invalid %s record data: %s", dns.TypeToString[rrType], data)
+	}
+	r.record = record
+
+	return nil
+}
+
+func isAnswerOption(field string) bool {
+	kv := strings.SplitN(field, OptionSeparator, 2)
+	return len(kv) == 2 && answerOptionKeys[strings.ToUpper(kv[0])]
+}
+
+func (r *AnswerRule) Apply(name string) (bool, string) {
+	return r.matcher.Apply(name)
+}
+
+func (r *AnswerRule) Options() *ruleOptions {
+	return r.matcher.Options()
+}
+
+// Get the record for the query name
+func (r *AnswerRule) answer(name string) dns.RR {
+	record := dns.Copy(r.record)
+	record.Header().Name = name
+	return record
+}
+
+// Group the Answer rules by name and add PTR records of the EXACT A and AAAA records
+func buildAnswerRules(rules []Rule) []Rule {
+	groups := make(map[string]*answerGroup)
+	groupKey := func(r *AnswerRule) string {
+		return fmt.Sprintf("%d|%s", r.matcher.Action, strings.ToLower(r.matcher.Pattern))
+	}
+	for _, rule := range rules {
+		ar := rule.(*AnswerRule)
+		key := groupKey(ar)
+		if groups[key] == nil {
+			groups[key] = new(answerGroup)
+		}
+		ar.group = groups[key]
+		ar.group.rules = append(ar.group.rules, ar)
+	}
+
+	// PTR records are generated only for reverse names without PTR Answer rules
+	all := append([]Rule(nil), rules...)
+	generated := make(map[string]*answerGroup)
+	for _, rule := range rules {
+		ar := rule.(*AnswerRule)
+		ip := recordAddress(ar.record)
+		if ar.matcher.Action != EXACT || ip == nil {
+			continue
+		}
+		name := reverseName(ip)
+		key := fmt.Sprintf("%d|%s", EXACT, name)
+		if groups[key] != nil {
+			continue
+		}
+		ptr := &AnswerRule{
+			matcher: &MatchingRule{Action: EXACT, Pattern: name},
+			Type:    dns.TypePTR,
+			record: &dns.PTR{
+				Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ar.record.Header().Ttl},
+				Ptr: ar.matcher.Pattern,
+			},
+		}
+		_, ptr.matcher.matchingRule = matchingFuncMap(EXACT)
+		// Same clients and schedule as the address record, the hits are counted by the address rule
+		ptr.matcher.options = *ar.Options()
+		ptr.matcher.options.Types = nil
+		if generated[key] == nil {
+			generated[key] = new(answerGroup)
+		}
+		ptr.group = generated[key]
+		ptr.group.rules = append(ptr.group.rules, ptr)
+		all = append(all, ptr)
+	}
+
+	return all
+}
+
+/*
+	Get the records of the group for the query, CNAME records are answered for any query type
+	and followed to the local records of the target.
+	Returns false when the last CNAME target has no local records.
+*/
+func (re *RuleEngine) answerRecords(rule *AnswerRule, query Query, metadata RequestMetadata) ([]dns.RR, bool) {
+	var records []dns.RR
+	now := re.clock()
+	name := query.Name
+
+	for hop := 0; rule != nil && hop < MaxCNAMEChain; hop++ {
+		var cnames, matched []dns.RR
+		for _, r := range rule.group.rules {
+			if !r.Options().match(Query{Name: name, Type: query.Type, Class: query.Class}, metadata, now) {
+				continue
+			}
+			if r.Type == dns.TypeCNAME {
+				cnames = append(cnames, r.answer(name))
+			} else if r.Type == query.Type || query.Type == dns.TypeANY {
+				matched = append(matched, r.answer(name))
+			}
+		}
+
+		// CNAME can't be with other data, only the first CNAME is used
+		if len(cnames) == 0 || query.Type == dns.TypeCNAME {
+			return append(records, append(matched, cnames...)...), true
+		}
+		records = append(records, cnames[0])
+		name = cnames[0].(*dns.CNAME).Target
+
+		// Target without local records is resolved by the upstream servers
+		next := re.index[AnswerType].match(name, Query{Name: name, Type: query.Type, Class: query.Class}, metadata, now)
+		rule, _ = next.(*AnswerRule)
+	}
+
+	return records, rule != nil
+}
+
+/*
+	Build the reply of the query with the local records
+	Returns the target of the last CNAME when it has no local records, the target is resolved by the upstream servers.
+*/
+func (re *RuleEngine) answerMsg(req *dns.Msg, query Query, metadata RequestMetadata, rule *AnswerRule) (*dns.Msg, string) {
+	msg := new(dns.Msg)
+	if req != nil {
+		msg.SetReply(req)
+	}
+	msg.RecursionAvailable = true
+	records, local := re.answerRecords(rule, query, metadata)
+	msg.Answer = records
+	if local || len(records) == 0 {
+		return msg, ""
+	}
+	cname, ok := records[len(records)-1].(*dns.CNAME)
+	if !ok {
+		return msg, ""
+	}
+	return msg, cname.Target
+}
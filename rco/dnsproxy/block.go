@@ -0,0 +1,111 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+const (
+	BlockRefused int8 = iota
+	BlockNXDomain
+	BlockNoData
+	BlockSinkhole
+	BlockCNAME
+)
+
+const (
+	// TTL of the records synthesized for blocked queries
+	BlockedRecordTTL = 60
+)
+
+var (
+	BlockModeMap = map[string]int8{
+		"REFUSED":  BlockRefused,
+		"NXDOMAIN": BlockNXDomain,
+		"NODATA":   BlockNoData,
+		"SINKHOLE": BlockSinkhole,
+		"CNAME":    BlockCNAME,
+	}
+)
+
+// Response returned to the client for blocked query
+type BlockResponse struct {
+	Mode   int8
+	IPv4   net.IP
+	IPv6   net.IP
+	Target string
+}
+
+/*
+	Parse block mode definition
+	Format: MODE[:VALUE]
+	refused, nxdomain, nodata, sinkhole[:IP,IP...], cname:HOST
+*/
+func NewBlockResponse(definition string) (error, *BlockResponse) {
+	mode, value := definition, ""
+	if i := strings.Index(definition, ":"); i >= 0 {
+		mode, value = definition[:i], definition[i+1:]
+	}
+
+	b := new(BlockResponse)
+	if val, ok := BlockModeMap[strings.ToUpper(mode)]; ok {
+		b.Mode = val
+	} else {
+		return fmt.Errorf("block mode %s not supported", mode), nil
+	}
+
+	switch b.Mode {
+	case BlockSinkhole:
+		b.IPv4 = net.IPv4zero
+		b.IPv6 = net.IPv6zero
+		if value == "" {
+			break
+		}
+		for _, addr := range strings.Split(value, ",") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return fmt.Errorf("sinkhole address must be valid IP: %s", addr), nil
+			}
+			if ip.To4() != nil {
+				b.IPv4 = ip
+			} else {
+				b.IPv6 = ip
+			}
+		}
+	case BlockCNAME:
+		if value == "" || !ValidateDNSFormat(strings.TrimSuffix(value, ".")) {
+			return fmt.Errorf("cname block mode must have valid target host: %s", value), nil
+		}
+		b.Target = dns.Fqdn(strings.ToLower(value))
+	default:
+		if value != "" {
+			return fmt.Errorf("block mode %s doesn't accept value: %s", mode, value), nil
+		}
+	}
+
+	return nil, b
+}
+
+// Set the rcode and add the synthesized records of the blocked question
+func (b *BlockResponse) answer(respMsg *dns.Msg, q dns.Question) {
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: q.Qclass, Ttl: BlockedRecordTTL}
+
+	switch b.Mode {
+	case BlockRefused:
+		mergeRcode(respMsg, dns.RcodeRefused)
+	case BlockNXDomain:
+		mergeRcode(respMsg, dns.RcodeNameError)
+	case BlockNoData:
+	case BlockSinkhole:
+		if q.Qtype == dns.TypeA {
+			respMsg.Answer = append(respMsg.Answer, &dns.A{Hdr: hdr, A: b.IPv4})
+		} else if q.Qtype == dns.TypeAAAA {
+			respMsg.Answer = append(respMsg.Answer, &dns.AAAA{Hdr: hdr, AAAA: b.IPv6})
+		}
+	case BlockCNAME:
+		hdr.Rrtype = dns.TypeCNAME
+		respMsg.Answer = append(respMsg.Answer, &dns.CNAME{Hdr: hdr, Target: b.Target})
+	}
+}
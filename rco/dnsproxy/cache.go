@@ -0,0 +1,182 @@
+package dnsproxy
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/armon/go-metrics"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+const (
+	CacheMaxEntriesDefaultConfig = 0
+	CacheMaxTTLDefaultConfig     = "1h"
+)
+
+type CacheConfig struct {
+	MaxEntries int    `mapstructure:"MaxEntries"`
+	MaxTTL     string `mapstructure:"MaxTTL"`
+	Enabled    bool
+}
+
+type cacheEntry struct {
+	key    string
+	msg    *dns.Msg
+	stored time.Time
+	expire time.Time
+}
+
+// Bounded LRU cache of upstream responses, records TTL is counted down on every hit
+type ResponseCache struct {
+	sync.Mutex
+
+	maxEntries int
+	maxTTL     time.Duration
+	entries    map[string]*list.Element
+	lru        *list.List
+	clock      func() time.Time
+}
+
+func NewResponseCache(maxEntries int, maxTTL time.Duration) *ResponseCache {
+	return &ResponseCache{
+		maxEntries: maxEntries,
+		maxTTL:     maxTTL,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		clock:      time.Now,
+	}
+}
+
+/*
+	Build the cache key of query after rewrites
+	The DO and CD bits and the client subnet of the request are forwarded to the upstream servers,
+	replies of requests that differ by them are cached apart.
+*/
+func CacheKey(query Query, region string, req *dns.Msg) string {
+	var do, cd bool
+	var subnet string
+	if req != nil {
+		cd = req.CheckingDisabled
+		if opt := req.IsEdns0(); opt != nil {
+			do = opt.Do()
+			for _, option := range opt.Option {
+				if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+					subnet = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("%s/%d/%d/%s/%t/%t/%s", dns.CanonicalName(query.Name), query.Type, query.Class, region, do, cd, subnet)
+}
+
+// Get copy of the cached response with TTLs reduced by the time spent in cache
+func (c *ResponseCache) Get(key string) *dns.Msg {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.countLookup("cache_miss")
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := c.clock()
+	if !now.Before(entry.expire) {
+		c.remove(elem)
+		c.countLookup("cache_miss")
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	c.countLookup("cache_hit")
+
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	forEachRecord(msg, func(rr dns.RR) {
+		if rr.Header().Ttl > elapsed {
+			rr.Header().Ttl -= elapsed
+		} else {
+			rr.Header().Ttl = 0
+		}
+	})
+	return msg
+}
+
+// Store copy of the response, responses without cacheable TTL are ignored
+func (c *ResponseCache) Set(key string, msg *dns.Msg) {
+	ttl := cacheTTL(msg)
+	if ttl <= 0 {
+		return
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.clock()
+	entry := &cacheEntry{key: key, msg: msg.Copy(), stored: now, expire: now.Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	// Evict the least recently used entries
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	if globalConfig.Telemetry.Enabled {
+		metrics.SetGauge([]string{"hoopoe", "cache_entries"}, float32(c.lru.Len()))
+	}
+}
+
+func (c *ResponseCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+func (c *ResponseCache) countLookup(name string) {
+	if globalConfig.Telemetry.Enabled {
+		metrics.IncrCounter([]string{"hoopoe", name}, 1)
+	}
+}
+
+/*
+	Get the time the response can be cached
+	Positive answers are cached by the minimal record TTL,
+	negative answers (NXDOMAIN/NODATA) by the SOA of the authority section (RFC 2308).
+*/
+func cacheTTL(msg *dns.Msg) time.Duration {
+	if msg.Truncated || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return 0
+	}
+
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		return time.Duration(minTTL(msg)) * time.Second
+	}
+
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return 0
+}
+
+// Run on every record of the message except the OPT pseudo record
+func forEachRecord(msg *dns.Msg, fn func(dns.RR)) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				fn(rr)
+			}
+		}
+	}
+}
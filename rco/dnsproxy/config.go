@@ -1,9 +1,11 @@
 package dnsproxy
 
 import (
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,66 +20,121 @@ const (
 	ClientMapPathDefaultConfig = ""
 	ScanAllDefaultConfig = true
 	UpstreamDefaultTimeout = "5s"
+	DrainDefaultTimeout = "10s"
+	WatchConfigDefaultConfig = false
+	BlockModeDefaultConfig = "refused"
+	ModeDefaultConfig = EnforceMode
+	DoTPortDefaultConfig = 853
 )
 
 type Config struct {
 	// Server Net Config
-	LBType       string           `mapstructure:"LBType"`
-	RemoteHosts  []UpstreamServer `mapstructure:"UpstreamServers"`
-	LocalAddress string           `mapstructure:"Address"`
+	LBType           string                    `mapstructure:"LBType"`
+	RemoteHosts      []UpstreamServer          `mapstructure:"UpstreamServers"`
+	UpstreamPolicies map[string]UpstreamPolicy `mapstructure:"UpstreamPolicies"`
+	LocalAddress     string                    `mapstructure:"Address"`
+	DoT              TLSListenerConfig         `mapstructure:"DoT"`
+	DoH              DoHConfig                 `mapstructure:"DoH"`
 
 	// General
 	Telemetry       TelemetryConfig `mapstructure:"Telemetry"`
+	Cache           CacheConfig     `mapstructure:"Cache"`
 	AccessLog       bool            `mapstructure:"EnableAccessLog"`
 	AccessLogPath   string          `mapstructure:"AccessLogPath"`
 	ClientMapFile   string          `mapstructure:"ClientMapFile"`
 	UpstreamTimeout string          `mapstructure:"UpstreamTimeout"`
+	DrainTimeout    string          `mapstructure:"DrainTimeout"`
+	WatchConfig     bool            `mapstructure:"WatchConfig"`
 
 	// Rule Config
-	ScanAll bool     `mapstructure:"ScanAll"`
-	Rules   []string `mapstructure:"ProxyRules"`
+	ScanAll   bool             `mapstructure:"ScanAll"`
+	BlockMode string           `mapstructure:"BlockMode"`
+	Mode      string           `mapstructure:"Mode"`
+	// Rule strings or structured rules
+	Rules     []interface{}             `mapstructure:"ProxyRules"`
+	RuleFiles []RuleFileConfig          `mapstructure:"RuleFiles"`
+	Schedules map[string]ScheduleConfig `mapstructure:"Schedules"`
+	// Rules applied to the records of the upstream replies
+	ResponseRules []string `mapstructure:"ResponseRules"`
+
+	// Path of the loaded config file
+	configFile string
+	// YAML nodes of the rules, used for the line numbers of errors
+	ruleNodes []*yaml.Node
 }
 
-func decodeConfig() Config {
+func decodeConfig(v *viper.Viper) (error, Config) {
 	var conf Config
-	if err := viper.Unmarshal(&conf); err != nil {
-		log.Fatalf("failed to parse config file, %s", err)
+	if err := v.Unmarshal(&conf); err != nil {
+		return fmt.Errorf("failed to parse config file, %s", err), conf
+	}
+	conf.configFile = v.ConfigFileUsed()
+	if ext := strings.ToLower(filepath.Ext(conf.configFile)); ext == ".yaml" || ext == ".yml" {
+		if err, nodes := loadRuleNodes(conf.configFile); err == nil && len(nodes) == len(conf.Rules) {
+			conf.ruleNodes = nodes
+		}
 	}
 	conf.Telemetry.Enabled = conf.Telemetry.Address != ""
+	conf.Cache.Enabled = conf.Cache.MaxEntries > 0
+	conf.DoT.Enabled = conf.DoT.CertFile != "" || conf.DoT.KeyFile != ""
+	if conf.DoT.Enabled && (conf.DoT.CertFile == "" || conf.DoT.KeyFile == "") {
+		return errors.New("DoT requires both CertFile and KeyFile"), conf
+	}
+	conf.DoH.Enabled = conf.DoH.Address != ""
+	if conf.DoH.Enabled && (conf.DoH.CertFile == "" || conf.DoH.KeyFile == "") {
+		return errors.New("DoH requires both CertFile and KeyFile"), conf
+	}
 
-	return conf
+	return nil, conf
 }
 
-func BuildConfig(filePath string) Config {
-	log.Infof("Loading config from: %s", filePath)
+// Load the config file, a directory path will be searched for config.yaml
+func LoadConfig(filePath string) (error, Config) {
+	v := viper.New()
 	fstat, err := os.Stat(filePath)
 	if err != nil {
-		fmt.Println(err)
-		log.Fatal("Failed to access config path.")
+		return fmt.Errorf("failed to access config path: %s", err), Config{}
 	}
 	if fstat.IsDir() {
-		viper.SetConfigName("config")
-		viper.SetConfigType("YAML")
-		viper.AddConfigPath(filePath)
+		v.SetConfigName("config")
+		v.SetConfigType("YAML")
+		v.AddConfigPath(filePath)
 	} else {
-		viper.SetConfigFile(filepath.Base(filePath))
-		viper.SetConfigType(strings.Replace(filepath.Ext(filePath), ".", "", 1))
+		v.SetConfigFile(filePath)
+		v.SetConfigType(strings.Replace(filepath.Ext(filePath), ".", "", 1))
 	}
 
-	viper.AddConfigPath(filepath.Dir(filePath))
-	viper.SetDefault("LBType", LBTypeDefaultConfig)
-	viper.SetDefault("Address", AddressDefaultConfig)
-	viper.SetDefault("Telemetry.Address", "")
-	viper.SetDefault("EnableAccessLog", EnableAccessLogDefaultConfig)
-	viper.SetDefault("AccessLogPath", AccessLogPathDefaultConfig)
-	viper.SetDefault("ClientMapFile", ClientMapPathDefaultConfig)
-	viper.SetDefault("ScanAll", ScanAllDefaultConfig)
-	viper.SetDefault("UpstreamTimeout", UpstreamDefaultTimeout)
+	v.AddConfigPath(filepath.Dir(filePath))
+	v.SetDefault("LBType", LBTypeDefaultConfig)
+	v.SetDefault("Address", AddressDefaultConfig)
+	v.SetDefault("Telemetry.Address", "")
+	v.SetDefault("Cache.MaxEntries", CacheMaxEntriesDefaultConfig)
+	v.SetDefault("Cache.MaxTTL", CacheMaxTTLDefaultConfig)
+	v.SetDefault("DoT.Port", DoTPortDefaultConfig)
+	v.SetDefault("DoH.Address", "")
+	v.SetDefault("EnableAccessLog", EnableAccessLogDefaultConfig)
+	v.SetDefault("AccessLogPath", AccessLogPathDefaultConfig)
+	v.SetDefault("ClientMapFile", ClientMapPathDefaultConfig)
+	v.SetDefault("ScanAll", ScanAllDefaultConfig)
+	v.SetDefault("BlockMode", BlockModeDefaultConfig)
+	v.SetDefault("Mode", ModeDefaultConfig)
+	v.SetDefault("UpstreamTimeout", UpstreamDefaultTimeout)
+	v.SetDefault("DrainTimeout", DrainDefaultTimeout)
+	v.SetDefault("WatchConfig", WatchConfigDefaultConfig)
 
-	err = viper.ReadInConfig()
+	if err = v.ReadInConfig(); err != nil {
+		return err, Config{}
+	}
+
+	return decodeConfig(v)
+}
+
+func BuildConfig(filePath string) Config {
+	log.Infof("Loading config from: %s", filePath)
+	err, conf := LoadConfig(filePath)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	return decodeConfig()
+	return conf
 }
@@ -0,0 +1,277 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DoHPath        = "/dns-query"
+	DoHContentType = "application/dns-message"
+	DoHMaxMsgSize  = dns.MaxMsgSize
+
+	// Timeouts of the HTTP connections, slow clients can't hold connections open
+	DoHReadHeaderTimeout = 5 * time.Second
+	DoHReadTimeout       = 10 * time.Second
+	DoHIdleTimeout       = 2 * time.Minute
+)
+
+type DoHConfig struct {
+	Address        string   `mapstructure:"Address"`
+	CertFile       string   `mapstructure:"CertFile"`
+	KeyFile        string   `mapstructure:"KeyFile"`
+	TrustedProxies []string `mapstructure:"TrustedProxies"`
+	Enabled        bool
+}
+
+// DNS-over-HTTPS (RFC 8484) server
+type DoHServer struct {
+	config  *DoHConfig
+	handler dns.Handler
+	server  *http.Server
+	trusted []*net.IPNet
+}
+
+func NewDoHServer(conf *DoHConfig, handler dns.Handler) (error, *DoHServer) {
+	s := new(DoHServer)
+	s.config = conf
+	s.handler = handler
+
+	err, trusted := parseTrustedProxies(conf.TrustedProxies)
+	if err != nil {
+		return err, nil
+	}
+	s.trusted = trusted
+
+	err, tlsConfig := NewServerTLSConfig(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return err, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(DoHPath, s.handleQuery)
+	s.server = &http.Server{
+		Addr:              conf.Address,
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: DoHReadHeaderTimeout,
+		ReadTimeout:       DoHReadTimeout,
+		IdleTimeout:       DoHIdleTimeout,
+	}
+
+	return nil, s
+}
+
+// Parse the trusted proxies allowed to set X-Forwarded-For, single IP is subnet of one address
+func parseTrustedProxies(proxies []string) (error, []*net.IPNet) {
+	var trusted []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid DoH trusted proxy %s: %s", proxy, err), nil
+		}
+		trusted = append(trusted, ipnet)
+	}
+	return nil, trusted
+}
+
+func (s *DoHServer) ListenAndServe() error {
+	// Certificates are already loaded into the TLS config
+	if err := s.server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Stop accepting new requests and wait for the active requests until the context is done
+func (s *DoHServer) Shutdown(ctx context.Context) error {
+	if err := s.server.Shutdown(ctx); err != nil {
+		return s.server.Close()
+	}
+	return nil
+}
+
+func (s *DoHServer) handleQuery(resp http.ResponseWriter, req *http.Request) {
+	err, msg := s.readMsg(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writer := &dohResponseWriter{
+		localAddr:  s.localAddr(req),
+		remoteAddr: s.clientAddr(req),
+	}
+	s.handler.ServeDNS(writer, msg)
+
+	if writer.msg == nil {
+		http.Error(resp, "no response", http.StatusInternalServerError)
+		return
+	}
+	data, err := writer.msg.Pack()
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", DoHContentType)
+	resp.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(minTTL(writer.msg))))
+	_, err = resp.Write(data)
+	handleError(err, 112)
+}
+
+// Read the DNS message from GET dns parameter or POST body
+func (s *DoHServer) readMsg(req *http.Request) (error, *dns.Msg) {
+	var data []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodGet:
+		param := req.URL.Query().Get("dns")
+		if param == "" {
+			return errors.New("missing dns parameter"), nil
+		}
+		if data, err = base64.RawURLEncoding.DecodeString(param); err != nil {
+			return fmt.Errorf("invalid dns parameter: %s", err), nil
+		}
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != DoHContentType {
+			return fmt.Errorf("unsupported content type: %s", req.Header.Get("Content-Type")), nil
+		}
+		if data, err = ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, DoHMaxMsgSize)); err != nil {
+			return fmt.Errorf("failed to read body: %s", err), nil
+		}
+	default:
+		return fmt.Errorf("method %s not supported", req.Method), nil
+	}
+
+	msg := new(dns.Msg)
+	if err = msg.Unpack(data); err != nil {
+		return fmt.Errorf("invalid dns message: %s", err), nil
+	}
+
+	return nil, msg
+}
+
+// Get the client address, X-Forwarded-For is used only when sent by a trusted proxy
+func (s *DoHServer) clientAddr(req *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP(host)}
+	addr.Port, _ = strconv.Atoi(port)
+
+	if !s.isTrusted(addr.IP) {
+		return addr
+	}
+
+	// Take the closest address that is not a trusted proxy
+	forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		addr = &net.TCPAddr{IP: ip}
+		if !s.isTrusted(ip) {
+			break
+		}
+	}
+
+	return addr
+}
+
+func (s *DoHServer) isTrusted(ip net.IP) bool {
+	for _, ipnet := range s.trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DoHServer) localAddr(req *http.Request) net.Addr {
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// Get the minimal TTL of the message records to be used as HTTP cache lifetime
+func minTTL(msg *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// dns.ResponseWriter implementation that keeps the response for the HTTP handler
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return w.localAddr
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *dohResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *dohResponseWriter) Write(data []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(data); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+	return len(data), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dohResponseWriter) Hijack() {
+	log.Warn("DoH connections can't be hijacked")
+}
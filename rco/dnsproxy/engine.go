@@ -1,27 +1,68 @@
 package dnsproxy
 
-import "github.com/miekg/dns"
+import (
+	"github.com/miekg/dns"
+	"net"
+)
 
 const (
 	ALLOWED int8 = 1 << iota
 	BLOCKED int8 = 1 << iota
 	ERROR   int8 = 1 << iota
+	// Query would have been blocked, resolved because the engine is in audit mode
+	AUDITED int8 = 1 << iota
+	// Query is answered with local records, without upstream lookup
+	ANSWERED int8 = 1 << iota
 )
 
 type Query struct {
-	Name string
-	Type uint16
+	Name  string
+	Type  uint16
+	Class uint16
 }
 
 type RequestMetadata struct {
 	Region    string
 	IPAddress string
+	IP        net.IP
+}
+
+// Build the metadata of the client request
+func NewRequestMetadata(regionMap *RegionMap, remoteAddr net.Addr) RequestMetadata {
+	var ip net.IP
+	switch addr := remoteAddr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		if host, _, err := net.SplitHostPort(remoteAddr.String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+
+	return RequestMetadata{
+		Region:    regionMap.GetRegion(ip.String()),
+		IPAddress: remoteAddr.String(),
+		IP:        ip,
+	}
+}
+
+// Rule that would have blocked the query in audit mode
+type AuditVerdict struct {
+	RuleID   string
+	RuleType string
+	Rule     string
 }
 
 type EngineQuery struct {
 	Queries []Query
 	Result  int8
-	dnsMsg  *dns.Msg
+	Block   *BlockResponse
+	Audit   *AuditVerdict
+	// CNAME target of ANSWERED query without local records, resolved by the upstream servers
+	Target string
+	dnsMsg *dns.Msg
 }
 
 type Engine interface {
@@ -0,0 +1,128 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Wildcard of single label
+	GlobLabel = "*"
+	// Wildcard of one or more labels
+	GlobLabels = "**"
+)
+
+var (
+	captureRefExpr = regexp.MustCompile(`\$([1-9])`)
+)
+
+// Wildcard pattern of DNS name, matched on label boundaries
+type globPattern struct {
+	labels    []string
+	wildcards int
+}
+
+func newGlobPattern(pattern string) (error, *globPattern) {
+	g := &globPattern{labels: splitLabels(pattern)}
+	for _, label := range g.labels {
+		if label == GlobLabel || label == GlobLabels {
+			g.wildcards++
+		} else if strings.Contains(label, GlobLabel) {
+			return fmt.Errorf("glob wildcard must be a whole label: %s", pattern), nil
+		}
+	}
+	return nil, g
+}
+
+// Match the name, returns the labels matched by every wildcard in order
+func (g *globPattern) match(name string) ([]string, bool) {
+	m := &globMatcher{pattern: g.labels, labels: splitLabels(name)}
+	m.failed = make([]bool, (len(m.pattern)+1)*(len(m.labels)+1))
+	return m.match(0, 0, nil)
+}
+
+// Backtracking matcher of the pattern labels to the name labels
+// Positions that failed to match are kept, they fail whatever was captured before them,
+// so patterns with several ** wildcards are matched in polynomial time.
+type globMatcher struct {
+	pattern []string
+	labels  []string
+	// Failed positions, indexed by pattern index * (labels count + 1) + label index
+	failed []bool
+}
+
+func (m *globMatcher) match(i int, j int, captures []string) ([]string, bool) {
+	if i == len(m.pattern) {
+		return captures, j == len(m.labels)
+	}
+	state := i*(len(m.labels)+1) + j
+	if m.failed[state] {
+		return nil, false
+	}
+	// Limit the captures capacity so every branch gets its own copy
+	captures = captures[:len(captures):len(captures)]
+
+	var result []string
+	ok := false
+	switch m.pattern[i] {
+	case GlobLabel:
+		if j < len(m.labels) {
+			result, ok = m.match(i+1, j+1, append(captures, m.labels[j]))
+		}
+	case GlobLabels:
+		for n := j + 1; n <= len(m.labels) && !ok; n++ {
+			result, ok = m.match(i+1, n, append(captures, strings.Join(m.labels[j:n], ".")))
+		}
+	default:
+		if j < len(m.labels) && strings.EqualFold(m.pattern[i], m.labels[j]) {
+			result, ok = m.match(i+1, j+1, captures)
+		}
+	}
+
+	if !ok {
+		m.failed[state] = true
+	}
+	return result, ok
+}
+
+// Validate the $n references of the replacement are matching wildcards of the pattern
+func validateCaptureRefs(replacement string, captures int) error {
+	for _, ref := range captureRefExpr.FindAllStringSubmatch(replacement, -1) {
+		if n, _ := strconv.Atoi(ref[1]); n > captures {
+			return fmt.Errorf("replacement reference %s has no matching wildcard", ref[0])
+		}
+	}
+	return nil
+}
+
+// Replace $n references with the labels captured by the n-th wildcard
+func expandCaptures(replacement string, captures []string) string {
+	return captureRefExpr.ReplaceAllStringFunc(replacement, func(ref string) string {
+		n, _ := strconv.Atoi(ref[1:])
+		if n > len(captures) {
+			return ""
+		}
+		return captures[n-1]
+	})
+}
+
+// Check if the name is the domain or subdomain of it
+func matchDomain(name string, domain string) bool {
+	if len(name) == len(domain) {
+		return strings.EqualFold(name, domain)
+	}
+	return len(name) > len(domain) &&
+		name[len(name)-len(domain)-1] == '.' &&
+		strings.EqualFold(name[len(name)-len(domain):], domain)
+}
+
+// Split the name to labels, the root label is ignored
+func splitLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
@@ -3,6 +3,7 @@ package dnsproxy
 import (
 	"errors"
 	"fmt"
+	"net"
 	"regexp"
 	"strings"
 )
@@ -13,20 +14,38 @@ func matchingFuncMap(action int8) (error, stringMatchingFunc) {
 	switch action {
 	case PREFIX:
 		return nil, func(rule *MatchingRule, source string) bool {
-			return strings.HasPrefix(source, rule.Pattern)
+			return hasPrefixFold(source, rule.Pattern)
 		}
 	case SUFFIX:
 		return nil, func(rule *MatchingRule, source string) bool {
-			return strings.HasSuffix(source, rule.Pattern)
+			return hasSuffixFold(source, rule.Pattern)
 		}
 	case SUBSTRING:
 		return nil, func(rule *MatchingRule, source string) bool {
-			return strings.Contains(source, rule.Pattern)
+			return indexFold(source, rule.Pattern) >= 0
 		}
 	case REGEXP:
 		return nil, func(rule *MatchingRule, source string) bool {
 			return rule.Regex.MatchString(source)
 		}
+	case EXACT:
+		return nil, func(rule *MatchingRule, source string) bool {
+			return strings.EqualFold(source, rule.Pattern)
+		}
+	case DOMAIN:
+		return nil, func(rule *MatchingRule, source string) bool {
+			return matchDomain(source, rule.Pattern)
+		}
+	case GLOB:
+		return nil, func(rule *MatchingRule, source string) bool {
+			_, matched := rule.glob.match(source)
+			return matched
+		}
+	case SUBNET:
+		return nil, func(rule *MatchingRule, source string) bool {
+			ip := parseReverseName(source)
+			return ip != nil && rule.subnet.Contains(ip)
+		}
 	default:
 		return errors.New("unknown matching action"), nil
 	}
@@ -34,12 +53,14 @@ func matchingFuncMap(action int8) (error, stringMatchingFunc) {
 
 // RULE-TYPE ACTION PATTERN OPTIONS
 type MatchingRule struct {
-	//options allowRuleOptions
+	options      ruleOptions
 	matchingRule stringMatchingFunc
 
 	Action  int8
 	Pattern string
 	Regex *regexp.Regexp
+	glob    *globPattern
+	subnet  *net.IPNet
 }
 
 func (r *MatchingRule) Parse(rawRule []string) error {
@@ -56,8 +77,8 @@ func (r *MatchingRule) Parse(rawRule []string) error {
 		return fmt.Errorf("action %s not supported", rawRule[ActionOffset])
 	}
 
-	// Validate the rule patterns match DNS standard + templating
-	if ValidateDNSFormat(rawRule[PatternOffset]) {
+	// Validate the rule patterns match DNS standard + templating, regexp, glob and subnet patterns are validated by their parsers
+	if r.Action != REGEXP && r.Action != SUBNET && r.Action != GLOB && !ValidateDNSPattern(rawRule[PatternOffset]) {
 		return fmt.Errorf("pattern must be valid dns string: %s", rawRule[PatternOffset])
 	}
 
@@ -69,12 +90,27 @@ func (r *MatchingRule) Parse(rawRule []string) error {
 	r.Pattern = rawRule[PatternOffset]
 
 	// Validate rulesEngine compiled before start running
-	if r.Action == REGEXP {
-		if regex, err := regexp.Compile(r.Pattern); err != nil {
+	switch r.Action {
+	case REGEXP:
+		if regex, err := regexp.Compile(CaseInsensitiveRegexp + r.Pattern); err != nil {
 			return fmt.Errorf("failed to parse Rewrite rule Regexp: %s", err)
 		} else {
 			r.Regex = regex
 		}
+	case DOMAIN:
+		r.Pattern = strings.TrimPrefix(r.Pattern, ".")
+	case GLOB:
+		if err, glob := newGlobPattern(r.Pattern); err != nil {
+			return err
+		} else {
+			r.glob = glob
+		}
+	case SUBNET:
+		if err, subnet := parseSubnet(r.Pattern); err != nil {
+			return err
+		} else {
+			r.subnet = subnet
+		}
 	}
 
 	// Build Function Map
@@ -84,6 +120,17 @@ func (r *MatchingRule) Parse(rawRule []string) error {
 		return fmt.Errorf("rewrite function not found, Action: %s\tMessage: %s",rawRule[ActionOffset], err)
 	}
 
+	// Parse rule options, SUBNET rules are applied to PTR queries by default
+	fields := rawRule[PatternOffset+1:]
+	if r.Action == SUBNET {
+		fields = append([]string{ReverseRuleTypes}, fields...)
+	}
+	if err, options := parseRuleOptions(RuleTypeMap[rawRule[RuleTypeOffset]], fields); err != nil {
+		return err
+	} else {
+		r.options = options
+	}
+
 	return nil
 }
 
@@ -91,6 +138,10 @@ func (r *MatchingRule) Apply(name string) (bool, string) {
 	return r.matchingRule(r, name), name
 }
 
+func (r *MatchingRule) Options() *ruleOptions {
+	return &r.options
+}
+
 func NewMatchingRule(rawRule []string) (error, *MatchingRule) {
 	r := new(MatchingRule)
 
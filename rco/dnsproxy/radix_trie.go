@@ -0,0 +1,105 @@
+package dnsproxy
+
+const (
+	// Entry matches any key starting with the entry path
+	matchAnyKind uint8 = iota
+	// Entry matches when the key ends after the entry path or continues with new label
+	matchLabelKind
+	// Entry matches only the key equal to the entry path
+	matchExactKind
+)
+
+type trieEntry struct {
+	index int
+	kind  uint8
+}
+
+// Compressed trie node, the label is the edge from the parent node
+type radixNode struct {
+	label    string
+	children map[byte]*radixNode
+	entries  []trieEntry
+}
+
+// Radix trie of rule patterns, lookup cost depends on the key length and not on the number of patterns
+type radixTrie struct {
+	root radixNode
+}
+
+func (t *radixTrie) insert(key string, entry trieEntry) {
+	node := &t.root
+	for {
+		if key == "" {
+			node.entries = append(node.entries, entry)
+			return
+		}
+
+		child := node.children[key[0]]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[byte]*radixNode)
+			}
+			node.children[key[0]] = &radixNode{label: key, entries: []trieEntry{entry}}
+			return
+		}
+
+		// Split the edge when the key diverges in the middle of it
+		common := 0
+		for common < len(key) && common < len(child.label) && key[common] == child.label[common] {
+			common++
+		}
+		if common < len(child.label) {
+			split := &radixNode{
+				label:    child.label[:common],
+				children: map[byte]*radixNode{child.label[common]: child},
+			}
+			child.label = child.label[common:]
+			node.children[key[0]] = split
+			child = split
+		}
+
+		key = key[common:]
+		node = child
+	}
+}
+
+// Call fn with every entry that matches the key, from the shortest path to the longest
+func (t *radixTrie) walk(key string, fn func(trieEntry)) {
+	node := &t.root
+	depth := 0
+	for {
+		for _, entry := range node.entries {
+			switch entry.kind {
+			case matchAnyKind:
+				fn(entry)
+			case matchLabelKind:
+				if depth == len(key) || key[depth] == '.' {
+					fn(entry)
+				}
+			case matchExactKind:
+				if depth == len(key) {
+					fn(entry)
+				}
+			}
+		}
+
+		if depth == len(key) {
+			return
+		}
+		child := node.children[key[depth]]
+		if child == nil || len(key)-depth < len(child.label) || key[depth:depth+len(child.label)] != child.label {
+			return
+		}
+		depth += len(child.label)
+		node = child
+	}
+}
+
+// Reverse the bytes of the name, suffixes of the name become prefixes
+func reverseString(s string) string {
+	b := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		b[len(s)-1-i] = s[i]
+	}
+	return string(b)
+}
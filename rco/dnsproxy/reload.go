@@ -0,0 +1,211 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// Time to wait for more file events before reloading, editors are writing files in several steps
+	ReloadDebounce = 500 * time.Millisecond
+)
+
+// Query processing state built from the config, replaced as a whole on reload
+type proxyState struct {
+	config        Config
+	engines       []Engine
+	rules         *RuleEngine
+	responses     *ResponseEngine
+	usManager     *UpstreamsManager
+	regionMap     RegionMap
+	blockResponse *BlockResponse
+}
+
+// Build all engines and managers from the config
+func newProxyState(conf Config) (error, *proxyState) {
+	var err error
+	state := &proxyState{config: conf}
+
+	// Default response for blocked queries
+	if err, state.blockResponse = NewBlockResponse(conf.BlockMode); err != nil {
+		return fmt.Errorf("invalid BlockMode: %s", err), nil
+	}
+
+	// Load Region Map
+	if err, state.regionMap = NewRegionMap(conf.ClientMapFile); err != nil {
+		return fmt.Errorf("failed to open client map file: %s, message: %s", conf.ClientMapFile, err), nil
+	}
+
+	// Rules of the rule files are added after the config rules
+	err, rules := buildRuleSources(conf)
+	if err != nil {
+		return err, nil
+	}
+	for _, ruleFile := range conf.RuleFiles {
+		err, fileRules := LoadRuleFile(ruleFile)
+		if err != nil {
+			return fmt.Errorf("failed to load rule file: %s, message: %s", ruleFile.Path, err), nil
+		}
+		for index, rule := range fileRules {
+			rules = append(rules, ruleSource{
+				fields:   strings.Fields(rule),
+				position: fmt.Sprintf("%s rule %d", ruleFile.Path, index),
+				file:     ruleFile.Path,
+			})
+		}
+	}
+
+	err, schedules := NewSchedules(conf.Schedules)
+	if err != nil {
+		return err, nil
+	}
+
+	// Load all engines and managers
+	err, rulesEngine := compileRuleEngine(rules, schedules)
+	if err != nil {
+		return err, nil
+	}
+	rulesEngine.SetScanAll(conf.ScanAll)
+	switch strings.ToLower(conf.Mode) {
+	case EnforceMode:
+	case AuditMode:
+		rulesEngine.SetAudit(true)
+	default:
+		return fmt.Errorf("invalid Mode: %s", conf.Mode), nil
+	}
+	state.rules = rulesEngine
+	if err, state.responses = NewResponseEngine(conf.ResponseRules); err != nil {
+		return err, nil
+	}
+	state.engines = append(state.engines, rulesEngine)
+	state.engines = append(state.engines, NewTemplateEngine())
+	if err, state.usManager = NewUpstreamsManager(
+		conf.RemoteHosts,
+		conf.UpstreamPolicies,
+		conf.LBType,
+		&state.regionMap,
+		conf.UpstreamTimeout,
+	); err != nil {
+		return err, nil
+	}
+
+	// Cache is starting empty on every reload since rules and upstreams may change
+	if conf.Cache.Enabled {
+		maxTTL, err := time.ParseDuration(conf.Cache.MaxTTL)
+		if err != nil {
+			state.usManager.Close()
+			return fmt.Errorf("failed to parse Cache.MaxTTL: %s", err), nil
+		}
+		state.usManager.SetCache(NewResponseCache(conf.Cache.MaxEntries, maxTTL))
+	}
+
+	return nil, state
+}
+
+// Get the state used for processing new queries
+func (d *DNSProxy) currentState() *proxyState {
+	return d.state.Load().(*proxyState)
+}
+
+/*
+	Reload the config, rules and client map and swap them with the running state
+	Queries already in process are finishing with the previous state,
+	when the new config is not valid the previous state is kept.
+*/
+func (d *DNSProxy) Reload() error {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	log.Infof("Reloading config from: %s", d.configPath)
+	err, conf := LoadConfig(d.configPath)
+	if err == nil {
+		var state *proxyState
+		if err, state = newProxyState(conf); err == nil {
+			previous := d.currentState()
+			state.rules.InheritStats(previous.rules)
+			d.state.Store(state)
+			previous.usManager.Close()
+			warnRestartRequired(&previous.config, &conf)
+			log.Info("Config reloaded successfully")
+			return nil
+		}
+	}
+
+	log.Errorf("Failed to reload config, keeping the previous config: %s", err)
+	return err
+}
+
+// Listeners, telemetry and access log are set only on startup
+func warnRestartRequired(previous *Config, current *Config) {
+	if previous.LocalAddress != current.LocalAddress ||
+		!reflect.DeepEqual(previous.DoT, current.DoT) ||
+		!reflect.DeepEqual(previous.DoH, current.DoH) ||
+		previous.Telemetry != current.Telemetry ||
+		previous.AccessLog != current.AccessLog ||
+		previous.AccessLogPath != current.AccessLogPath ||
+		previous.DrainTimeout != current.DrainTimeout {
+		log.Warning("Listeners, Telemetry, AccessLog and DrainTimeout changes require restart to apply")
+	}
+}
+
+// Reload on changes of the config file, the client map file or the rule files
+func (d *DNSProxy) watchConfig() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	d.watcher = watcher
+
+	// Directories are watched since editors are replacing the files
+	watchFiles := func() map[string]bool {
+		conf := d.currentState().config
+		files := make(map[string]bool)
+		paths := []string{conf.configFile, conf.ClientMapFile}
+		for _, ruleFile := range conf.RuleFiles {
+			paths = append(paths, ruleFile.Path)
+		}
+		for _, file := range paths {
+			if file == "" {
+				continue
+			}
+			if abs, err := filepath.Abs(file); err == nil {
+				files[abs] = true
+				handleError(watcher.Add(filepath.Dir(abs)), 110)
+			}
+		}
+		return files
+	}
+	files := watchFiles()
+
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if abs, err := filepath.Abs(event.Name); err == nil && files[abs] {
+					debounce = time.After(ReloadDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				handleError(err, 127)
+			case <-debounce:
+				debounce = nil
+				if d.Reload() == nil {
+					files = watchFiles()
+				}
+			}
+		}
+	}()
+
+	return nil
+}
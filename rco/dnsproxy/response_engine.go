@@ -0,0 +1,312 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	NatResponse int8 = iota
+	TargetResponse
+	DropResponse
+)
+
+var (
+	ResponseTypeMap = map[string]int8{
+		"NAT":    NatResponse,
+		"TARGET": TargetResponse,
+		"DROP":   DropResponse,
+	}
+
+	// Record types the response rules are applied to when types option is not set
+	ResponseDefaultTypes = map[int8]string{
+		NatResponse:    "A,AAAA",
+		TargetResponse: "CNAME,MX,SRV",
+		DropResponse:   "A,AAAA,CNAME,MX,SRV",
+	}
+)
+
+/*
+	Response rule, applied to the records of the upstream reply
+	NAT FROM-SUBNET TO-SUBNET OPTIONS                - map A/AAAA addresses from one subnet to the other
+	TARGET ACTION PATTERN REPLACEMENT OPTIONS        - rewrite CNAME/MX/SRV targets
+	DROP ACTION PATTERN OPTIONS                      - drop records by name or target, addresses are matched by SUBNET
+*/
+type responseRule struct {
+	kind    int8
+	options *ruleOptions
+	// Subnets of NAT rule
+	from *net.IPNet
+	to   *net.IPNet
+	// Rewrite rule of TARGET, matching rule of DROP
+	rule Rule
+}
+
+// Engine of the response rules, runs on the upstream reply after the UpstreamsManager
+type ResponseEngine struct {
+	rules []*responseRule
+	clock func() time.Time
+}
+
+func NewResponseEngine(rawRules []string) (error, *ResponseEngine) {
+	engine := &ResponseEngine{clock: time.Now}
+
+	for index, rawRule := range rawRules {
+		err, rule := parseResponseRule(strings.Fields(rawRule))
+		if err != nil {
+			return fmt.Errorf("response rule %d - %s", index, err), nil
+		}
+		engine.rules = append(engine.rules, rule)
+	}
+
+	log.Infof("Loaded %d response rules", len(engine.rules))
+	return nil, engine
+}
+
+func parseResponseRule(fields []string) (error, *responseRule) {
+	if len(fields) < PatternOffset+1 {
+		return fmt.Errorf("response rule must have at least %d fields", PatternOffset+1), nil
+	}
+	kind, ok := ResponseTypeMap[strings.ToUpper(fields[RuleTypeOffset])]
+	if !ok {
+		return fmt.Errorf("unsupported response rule type - \"%s\"", fields[RuleTypeOffset]), nil
+	}
+	rule := &responseRule{kind: kind}
+	defaultTypes := TypesOption + OptionSeparator + ResponseDefaultTypes[kind]
+
+	switch kind {
+	case NatResponse:
+		err, from, to := parseSubnetMapping(fields[1], fields[2])
+		if err != nil {
+			return err, nil
+		}
+		err, options := parseRuleOptions(PassType, append([]string{defaultTypes}, fields[3:]...))
+		if err != nil {
+			return err, nil
+		}
+		rule.from, rule.to, rule.options = from, to, &options
+	case TargetResponse:
+		// Targets are rewritten by the Rewrite rule actions
+		fields = append([]string{"REWRITE"}, fields[1:]...)
+		normalizeRuleFields(fields)
+		if len(fields) <= ReplacementOffset {
+			return fmt.Errorf("target definition must have at least %d fields", ReplacementOffset+1), nil
+		}
+		options := append([]string{defaultTypes}, fields[ReplacementOffset+1:]...)
+		fields = append(fields[:ReplacementOffset+1:ReplacementOffset+1], options...)
+		err, rw := NewRewriteRule(fields)
+		if err != nil {
+			return err, nil
+		}
+		rule.rule, rule.options = rw, rw.Options()
+	case DropResponse:
+		fields = append([]string{"PASS"}, fields[1:]...)
+		normalizeRuleFields(fields)
+		options := append([]string{defaultTypes}, fields[PatternOffset+1:]...)
+		fields = append(fields[:PatternOffset+1:PatternOffset+1], options...)
+		err, mr := NewMatchingRule(fields)
+		if err != nil {
+			return err, nil
+		}
+		rule.rule, rule.options = mr, mr.Options()
+	}
+
+	return nil, rule
+}
+
+func (re *ResponseEngine) Name() string {
+	return "ResponseEngine"
+}
+
+func (re *ResponseEngine) Apply(query *EngineQuery, metadata RequestMetadata) (*EngineQuery, error) {
+	if query == nil || len(query.Queries) <= 0 {
+		return nil, errors.New("can't get as input empty EngineQuery")
+	}
+	result := new(EngineQuery)
+	result.Queries = query.Queries
+	result.Result = query.Result
+	result.dnsMsg = query.dnsMsg
+	if query.dnsMsg == nil || len(re.rules) == 0 {
+		return result, nil
+	}
+
+	now := re.clock()
+	msg := query.dnsMsg
+	// Old targets of the rewritten records, their records are not the records of the new targets
+	renames := make(map[string]string)
+	changed := false
+	applySection := func(records []dns.RR) []dns.RR {
+		kept := records[:0]
+		for _, rr := range records {
+			keep, modified := re.applyRecord(rr, metadata, now, renames)
+			changed = changed || modified || !keep
+			if keep {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	msg.Answer = applySection(msg.Answer)
+	msg.Extra = applySection(msg.Extra)
+
+	if len(renames) > 0 {
+		result.Target = cutTargetChain(msg, query.Queries[0], renames)
+	}
+	// Modified records are not the records the upstream validated
+	if changed {
+		msg.AuthenticatedData = false
+	}
+
+	return result, nil
+}
+
+/*
+	Drop the records of the old targets and the CNAME chain after the rewritten CNAME target
+	The records of the old target are published by the upstream for the old name, the new target is resolved by the proxy.
+	Returns the rewritten CNAME target of the query, empty when the query is not answered by rewritten CNAME.
+*/
+func cutTargetChain(msg *dns.Msg, query Query, renames map[string]string) string {
+	newTargets := make(map[string]bool, len(renames))
+	for _, target := range renames {
+		newTargets[strings.ToLower(target)] = true
+	}
+
+	// Follow the CNAME chain of the query name up to the first rewritten target
+	var chain []dns.RR
+	target := ""
+	name := query.Name
+	for len(chain) < len(msg.Answer) && target == "" {
+		var next dns.RR
+		for _, rr := range msg.Answer {
+			if _, ok := rr.(*dns.CNAME); ok && strings.EqualFold(rr.Header().Name, name) {
+				next = rr
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		chain = append(chain, next)
+		name = next.(*dns.CNAME).Target
+		if newTargets[strings.ToLower(name)] {
+			target = name
+		}
+	}
+	if target != "" {
+		msg.Answer = chain
+	}
+
+	dropOld := func(records []dns.RR) []dns.RR {
+		kept := records[:0]
+		for _, rr := range records {
+			if _, ok := renames[strings.ToLower(rr.Header().Name)]; !ok {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	msg.Answer = dropOld(msg.Answer)
+	msg.Extra = dropOld(msg.Extra)
+
+	if query.Type == dns.TypeCNAME {
+		return ""
+	}
+	return target
+}
+
+// Apply the rules on the record in order, returns if the record is kept and if it was modified
+func (re *ResponseEngine) applyRecord(rr dns.RR, metadata RequestMetadata, now time.Time, renames map[string]string) (bool, bool) {
+	header := rr.Header()
+	if header.Rrtype == dns.TypeOPT {
+		return true, false
+	}
+	record := Query{Name: header.Name, Type: header.Rrtype, Class: header.Class}
+	modified := false
+
+	for _, rule := range re.rules {
+		if !rule.options.match(record, metadata, now) {
+			continue
+		}
+		switch rule.kind {
+		case NatResponse:
+			ip := recordAddress(rr)
+			if ip != nil && rule.from.Contains(ip) {
+				setRecordAddress(rr, mapSubnet(ip, rule.from, rule.to))
+				modified = true
+			}
+		case TargetResponse:
+			target, ok := recordTarget(rr)
+			if !ok {
+				continue
+			}
+			if rewritten, newTarget := rule.rule.Apply(target); rewritten && newTarget != target {
+				setRecordTarget(rr, dns.Fqdn(newTarget))
+				renames[strings.ToLower(target)] = dns.Fqdn(newTarget)
+				modified = true
+			}
+		case DropResponse:
+			// Records are matched by the name and the target, addresses by their reverse lookup name
+			values := []string{header.Name}
+			if target, ok := recordTarget(rr); ok {
+				values = append(values, target)
+			}
+			if ip := recordAddress(rr); ip != nil {
+				values = append(values, reverseName(ip))
+			}
+			for _, value := range values {
+				if matched, _ := rule.rule.Apply(value); matched {
+					return false, modified
+				}
+			}
+		}
+	}
+
+	return true, modified
+}
+
+func recordAddress(rr dns.RR) net.IP {
+	switch record := rr.(type) {
+	case *dns.A:
+		return record.A
+	case *dns.AAAA:
+		return record.AAAA
+	}
+	return nil
+}
+
+func setRecordAddress(rr dns.RR, ip net.IP) {
+	switch record := rr.(type) {
+	case *dns.A:
+		record.A = ip
+	case *dns.AAAA:
+		record.AAAA = ip
+	}
+}
+
+func recordTarget(rr dns.RR) (string, bool) {
+	switch record := rr.(type) {
+	case *dns.CNAME:
+		return record.Target, true
+	case *dns.MX:
+		return record.Mx, true
+	case *dns.SRV:
+		return record.Target, true
+	}
+	return "", false
+}
+
+func setRecordTarget(rr dns.RR, target string) {
+	switch record := rr.(type) {
+	case *dns.CNAME:
+		record.Target = target
+	case *dns.MX:
+		record.Mx = target
+	case *dns.SRV:
+		record.Target = target
+	}
+}
@@ -0,0 +1,110 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	IPv4ReverseDomain = "in-addr.arpa."
+	IPv6ReverseDomain = "ip6.arpa."
+
+	// Types option of the SUBNET rules when types option is not set
+	ReverseRuleTypes = TypesOption + OptionSeparator + "PTR"
+)
+
+// Parse IP subnet pattern of SUBNET rules, single IP is subnet of one address
+func parseSubnet(pattern string) (error, *net.IPNet) {
+	pattern = strings.TrimSuffix(pattern, ".")
+	if !strings.Contains(pattern, "/") {
+		if ip := net.ParseIP(pattern); ip != nil {
+			return nil, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ipBytes(ip))*8, len(ipBytes(ip))*8)}
+		}
+	}
+	_, subnet, err := net.ParseCIDR(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid subnet: %s", pattern), nil
+	}
+	return nil, subnet
+}
+
+// Parse subnets mapped one to one, both must be of the same family and size
+func parseSubnetMapping(from string, to string) (error, *net.IPNet, *net.IPNet) {
+	err, fromSubnet := parseSubnet(from)
+	if err != nil {
+		return err, nil, nil
+	}
+	err, toSubnet := parseSubnet(to)
+	if err != nil {
+		return err, nil, nil
+	}
+	fromOnes, fromBits := fromSubnet.Mask.Size()
+	toOnes, toBits := toSubnet.Mask.Size()
+	if fromOnes != toOnes || fromBits != toBits {
+		return fmt.Errorf("subnets must be of the same family and size: %s %s", from, to), nil, nil
+	}
+	return nil, fromSubnet, toSubnet
+}
+
+// Get the IP of reverse lookup name, nil when the name is not of single address
+func parseReverseName(name string) net.IP {
+	switch {
+	case matchDomain(name, IPv4ReverseDomain):
+		labels := splitLabels(name[:len(name)-len(IPv4ReverseDomain)])
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(octet)
+		}
+		return ip
+	case matchDomain(name, IPv6ReverseDomain):
+		labels := splitLabels(name[:len(name)-len(IPv6ReverseDomain)])
+		if len(labels) != net.IPv6len*2 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			ip[net.IPv6len-1-i/2] |= byte(nibble) << (4 * uint(i%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// Move the address from one subnet to the same place in another subnet of the same size
+func mapSubnet(ip net.IP, from *net.IPNet, to *net.IPNet) net.IP {
+	ip = ipBytes(ip)
+	base := ipBytes(to.IP)
+	mapped := make(net.IP, len(ip))
+	for i := range ip {
+		mapped[i] = base[i]&to.Mask[i] | ip[i]&^from.Mask[i]
+	}
+	return mapped
+}
+
+// Get the reverse lookup name of the address
+func reverseName(ip net.IP) string {
+	name, _ := dns.ReverseAddr(ip.String())
+	return name
+}
+
+// IPv4 addresses as 4 bytes, same length as the masks of IPv4 subnets
+func ipBytes(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
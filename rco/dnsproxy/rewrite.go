@@ -3,7 +3,9 @@ package dnsproxy
 import (
 	"errors"
 	"fmt"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -11,8 +13,25 @@ const (
 	ReplacementOffset = 3
 )
 
+const (
+	ReplacementsOption = "N"
+	DirectionOption    = "FROM"
+	RegexpMatchOption  = "MATCH"
+
+	AllValue   = "ALL"
+	LeftValue  = "LEFT"
+	RightValue = "RIGHT"
+	FirstValue = "FIRST"
+)
+
 type rewriteOptions struct {
+	ruleOptions
+	// Max number of SUBSTRING replacements, -1 is all occurrences
 	SubstringReplacements int
+	// Replace SUBSTRING occurrences from the end of the name
+	FromRight bool
+	// Replace only the first REGEXP match
+	FirstMatch bool
 }
 
 type rewriteFunc func(*RewriteRule, string) (bool, string)
@@ -26,6 +45,10 @@ type RewriteRule struct {
 	Pattern     string
 	Replacement string
 	Regex       *regexp.Regexp
+	glob        *globPattern
+	// Subnets of SUBNET rewrite, reverse lookup names are moved from the pattern to the replacement
+	subnet      *net.IPNet
+	replacement *net.IPNet
 }
 
 func NewRewriteRule(rawRule []string) (error, *RewriteRule) {
@@ -50,8 +73,8 @@ func (r *RewriteRule) Parse(rawRule []string) error {
 		return fmt.Errorf("action %s not supported", rawRule[ActionOffset])
 	}
 
-	// Validate the rule patterns match DNS standard + templating
-	if ValidateDNSFormat(rawRule[PatternOffset]) {
+	// Validate the rule patterns match DNS standard + templating, regexp, glob and subnet patterns are validated by their parsers
+	if r.Action != REGEXP && r.Action != SUBNET && r.Action != GLOB && !ValidateDNSPattern(rawRule[PatternOffset]) {
 		return fmt.Errorf("rewrite pattern must be valid dns string: %s", rawRule[PatternOffset])
 	}
 	//if ValidateDNSFormat(rawRule[ReplacementOffset]) {
@@ -68,17 +91,38 @@ func (r *RewriteRule) Parse(rawRule []string) error {
 	// Build rule
 	r.Pattern = rawRule[PatternOffset]
 	r.Replacement = rawRule[ReplacementOffset]
-	// Add . suffix
-	if !strings.HasSuffix(r.Replacement , ".") {
+	// Add . suffix to the replacements of name ends, prefix and substring replacements may be inside a label
+	if hasNameEnd(r.Action) && !strings.HasSuffix(r.Replacement , ".") {
 		r.Replacement  += "."
 	}
 
 	// Compile Regex pattern
 	if r.Action == REGEXP {
-		if pattern, err := regexp.Compile(r.Pattern); err != nil {
-			r.Regex = pattern
-		} else {
+		if pattern, err := regexp.Compile(CaseInsensitiveRegexp + r.Pattern); err != nil {
 			return fmt.Errorf("failed to parse Rewrite rule Regexp: %s", err)
+		} else {
+			r.Regex = pattern
+		}
+	}
+	if r.Action == DOMAIN {
+		r.Pattern = strings.TrimPrefix(r.Pattern, ".")
+	}
+
+	// Compile Glob pattern, $n of the replacement is the name part matched by the n-th wildcard
+	if r.Action == GLOB {
+		err, glob := newGlobPattern(r.Pattern)
+		if err != nil {
+			return err
+		}
+		if err = validateCaptureRefs(r.Replacement, glob.wildcards); err != nil {
+			return err
+		}
+		r.glob = glob
+	}
+
+	if r.Action == SUBNET {
+		if err := r.parseSubnets(); err != nil {
+			return err
 		}
 	}
 
@@ -89,49 +133,167 @@ func (r *RewriteRule) Parse(rawRule []string) error {
 		return fmt.Errorf("rewrite function not found, Action: %s\tMessage: %s",rawRule[ActionOffset], err)
 	}
 
-	// TODO: Add support for limiting the number of replacement occurs
-	r.options.SubstringReplacements = 0
+	// Parse rewrite options, the rest are common rule options
+	err, fields := r.options.parse(r.Action, rawRule[ReplacementOffset+1:])
+	if err != nil {
+		return err
+	}
+	// SUBNET rules are applied to PTR queries by default
+	if r.Action == SUBNET {
+		fields = append([]string{ReverseRuleTypes}, fields...)
+	}
+
+	// Parse rule options
+	if err, options := parseRuleOptions(RewriteType, fields); err != nil {
+		return err
+	} else {
+		r.options.ruleOptions = options
+	}
 
 	return nil
 }
 
+// Parse the subnets of SUBNET rewrite
+func (r *RewriteRule) parseSubnets() error {
+	err, subnet, replacement := parseSubnetMapping(r.Pattern, r.Replacement)
+	if err != nil {
+		return err
+	}
+	r.subnet, r.replacement = subnet, replacement
+	return nil
+}
+
+/*
+	Parse the options of the rewrite action and return the other options
+	n=COUNT|all and from=left|right are limiting SUBSTRING replacements, match=first|all is for REGEXP.
+*/
+func (o *rewriteOptions) parse(action int8, fields []string) (error, []string) {
+	var others []string
+	o.SubstringReplacements = -1
+
+	for _, field := range fields {
+		kv := strings.SplitN(field, OptionSeparator, 2)
+		if len(kv) != 2 {
+			others = append(others, field)
+			continue
+		}
+
+		key, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+		switch key {
+		case ReplacementsOption, DirectionOption:
+			if action != SUBSTRING {
+				return fmt.Errorf("option %s supported only by SUBSTRING rewrites", kv[0]), nil
+			}
+		case RegexpMatchOption:
+			if action != REGEXP {
+				return fmt.Errorf("option %s supported only by REGEXP rewrites", kv[0]), nil
+			}
+		default:
+			others = append(others, field)
+			continue
+		}
+
+		switch {
+		case key == ReplacementsOption && value == AllValue:
+			o.SubstringReplacements = -1
+		case key == ReplacementsOption:
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("option %s must be positive number or all: %s", kv[0], kv[1]), nil
+			}
+			o.SubstringReplacements = n
+		case key == DirectionOption && (value == LeftValue || value == RightValue):
+			o.FromRight = value == RightValue
+		case key == RegexpMatchOption && (value == FirstValue || value == AllValue):
+			o.FirstMatch = value == FirstValue
+		default:
+			return fmt.Errorf("invalid value of option %s: %s", kv[0], kv[1]), nil
+		}
+	}
+
+	return nil, others
+}
+
 func (r *RewriteRule) Apply(name string) (bool, string) {
 	return r.rwRule(r, name)
 }
 
+func (r *RewriteRule) Options() *ruleOptions {
+	return &r.options.ruleOptions
+}
+
 func rewriteFuncMap(action int8) (error, rewriteFunc) {
 	switch action {
 	case PREFIX:
 		return nil, func(rule *RewriteRule, req string) (bool, string) {
-			if strings.HasPrefix(req, rule.Pattern) {
-				resp := rule.Replacement + strings.TrimPrefix(req, rule.Pattern)
+			if hasPrefixFold(req, rule.Pattern) {
+				resp := rule.Replacement + req[len(rule.Pattern):]
 				return true, resp
 			}
 			return false, req
 		}
 	case SUFFIX:
 		return nil, func(rule *RewriteRule, req string) (bool, string) {
-			if strings.HasSuffix(req, rule.Pattern) {
-				resp := strings.TrimSuffix(req, rule.Pattern) + rule.Replacement
+			if hasSuffixFold(req, rule.Pattern) {
+				resp := req[:len(req)-len(rule.Pattern)] + rule.Replacement
 				return true, resp
 			}
 			return false, req
 		}
 	case SUBSTRING:
 		return nil, func(rule *RewriteRule, req string) (bool, string) {
-			if strings.Contains(req, rule.Pattern) {
-				resp := strings.Replace(req, rule.Pattern, rule.Replacement, rule.options.SubstringReplacements)
-				return true, resp
+			if indexFold(req, rule.Pattern) < 0 {
+				return false, req
 			}
-			return false, req
+			if rule.options.FromRight {
+				return true, replaceFoldRight(req, rule.Pattern, rule.Replacement, rule.options.SubstringReplacements)
+			}
+			return true, replaceFold(req, rule.Pattern, rule.Replacement, rule.options.SubstringReplacements)
 		}
 	case REGEXP:
 		return nil, func(rule *RewriteRule, req string) (bool, string) {
-			if rule.Regex != nil {
-				resp := rule.Regex.ReplaceAllString(req, rule.Replacement)
-				return true, resp
+			if !rule.options.FirstMatch {
+				if !rule.Regex.MatchString(req) {
+					return false, req
+				}
+				return true, rule.Regex.ReplaceAllString(req, rule.Replacement)
 			}
 
+			// Replace only the first match
+			match := rule.Regex.FindStringSubmatchIndex(req)
+			if match == nil {
+				return false, req
+			}
+			resp := rule.Regex.ExpandString(nil, rule.Replacement, req, match)
+			return true, req[:match[0]] + string(resp) + req[match[1]:]
+		}
+	case EXACT:
+		return nil, func(rule *RewriteRule, req string) (bool, string) {
+			if strings.EqualFold(req, rule.Pattern) {
+				return true, rule.Replacement
+			}
+			return false, req
+		}
+	case DOMAIN:
+		// Replace the domain and keep the subdomain labels
+		return nil, func(rule *RewriteRule, req string) (bool, string) {
+			if matchDomain(req, rule.Pattern) {
+				return true, req[:len(req)-len(rule.Pattern)] + rule.Replacement
+			}
+			return false, req
+		}
+	case GLOB:
+		return nil, func(rule *RewriteRule, req string) (bool, string) {
+			if captures, ok := rule.glob.match(req); ok {
+				return true, expandCaptures(rule.Replacement, captures)
+			}
+			return false, req
+		}
+	case SUBNET:
+		return nil, func(rule *RewriteRule, req string) (bool, string) {
+			if ip := parseReverseName(req); ip != nil && rule.subnet.Contains(ip) {
+				return true, reverseName(mapSubnet(ip, rule.subnet, rule.replacement))
+			}
 			return false, req
 		}
 	default:
@@ -0,0 +1,197 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	RuleFieldType        = "type"
+	RuleFieldMatch       = "match"
+	RuleFieldPattern     = "pattern"
+	RuleFieldReplacement = "replacement"
+	RuleFieldOptions     = "options"
+	RuleFieldRecord      = "record"
+)
+
+// Rule fields to compile with the position of the rule definition for errors
+type ruleSource struct {
+	fields   []string
+	position string
+	// Path of the rule file, empty for the config rules
+	file string
+}
+
+/*
+	Build the fields of all the rules of the config
+	Rules are defined as string: "TYPE ACTION PATTERN [REPLACEMENT] OPTIONS"
+	or as structured rule:
+		type: Rewrite
+		match: SUFFIX
+		pattern: corp.local
+		replacement: corp.example.com
+		options: {types: [A, AAAA], name: corp}
+	Answer rules have record field instead of replacement: "A 10.0.0.5".
+*/
+func buildRuleSources(conf Config) (error, []ruleSource) {
+	var sources []ruleSource
+	for index, raw := range conf.Rules {
+		position := fmt.Sprintf("rule %d", index)
+		var node *yaml.Node
+		if index < len(conf.ruleNodes) {
+			node = conf.ruleNodes[index]
+			position = fmt.Sprintf("%s:%d", conf.configFile, node.Line)
+		}
+
+		if rule, ok := raw.(string); ok {
+			sources = append(sources, ruleSource{fields: strings.Fields(rule), position: position})
+			continue
+		}
+
+		// Structured rules of formats without line numbers are converted to YAML nodes
+		if node == nil {
+			node = new(yaml.Node)
+			if err := node.Encode(raw); err != nil {
+				return fmt.Errorf("%s: invalid rule: %s", position, err), nil
+			}
+		}
+		err, fields := decodeRuleNode(conf.configFile, node)
+		if err != nil && node.Line == 0 {
+			return fmt.Errorf("%s: %s", position, err), nil
+		} else if err != nil {
+			return err, nil
+		}
+		sources = append(sources, ruleSource{fields: fields, position: position})
+	}
+
+	return nil, sources
+}
+
+// Convert structured rule to the fields of the string format, errors are reported with the line of the field
+func decodeRuleNode(file string, node *yaml.Node) (error, []string) {
+	if node.Kind != yaml.MappingNode {
+		return nodeError(file, node, "rule must be string or mapping"), nil
+	}
+
+	values := make(map[string]string)
+	var options []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		switch name := strings.ToLower(key.Value); name {
+		case RuleFieldType, RuleFieldMatch, RuleFieldPattern, RuleFieldReplacement, RuleFieldRecord:
+			if value.Kind != yaml.ScalarNode || value.Value == "" {
+				return nodeError(file, value, "rule field %s must be non empty string", key.Value), nil
+			}
+			values[name] = value.Value
+		case RuleFieldOptions:
+			err, opts := decodeRuleOptionsNode(file, value)
+			if err != nil {
+				return err, nil
+			}
+			options = opts
+		default:
+			return nodeError(file, key, "unknown rule field %s", key.Value), nil
+		}
+	}
+
+	for _, name := range []string{RuleFieldType, RuleFieldMatch, RuleFieldPattern} {
+		if values[name] == "" {
+			return nodeError(file, node, "rule field %s is required", name), nil
+		}
+	}
+	ruleType, ok := RuleTypeMap[strings.ToUpper(values[RuleFieldType])]
+	if !ok {
+		return nodeError(file, node, "rule type %s not supported", values[RuleFieldType]), nil
+	}
+	if _, ok := ActionMap[strings.ToUpper(values[RuleFieldMatch])]; !ok {
+		return nodeError(file, node, "match %s not supported", values[RuleFieldMatch]), nil
+	}
+	_, hasReplacement := values[RuleFieldReplacement]
+	if ruleType == RewriteType && !hasReplacement {
+		return nodeError(file, node, "rule field replacement is required by Rewrite rules"), nil
+	} else if ruleType != RewriteType && hasReplacement {
+		return nodeError(file, node, "rule field replacement is supported only by Rewrite rules"), nil
+	}
+
+	_, hasRecord := values[RuleFieldRecord]
+	if ruleType == AnswerType && !hasRecord {
+		return nodeError(file, node, "rule field record is required by Answer rules"), nil
+	} else if ruleType != AnswerType && hasRecord {
+		return nodeError(file, node, "rule field record is supported only by Answer rules"), nil
+	}
+
+	fields := []string{values[RuleFieldType], values[RuleFieldMatch], values[RuleFieldPattern]}
+	if hasReplacement {
+		fields = append(fields, values[RuleFieldReplacement])
+	}
+	if hasRecord {
+		fields = append(fields, strings.Fields(values[RuleFieldRecord])...)
+	}
+	return nil, append(fields, options...)
+}
+
+// Convert the options mapping to KEY=VALUE fields, list values are joined by comma
+func decodeRuleOptionsNode(file string, node *yaml.Node) (error, []string) {
+	if node.Kind != yaml.MappingNode {
+		return nodeError(file, node, "rule options must be mapping"), nil
+	}
+
+	var options []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		var values []string
+		switch value.Kind {
+		case yaml.ScalarNode:
+			values = append(values, value.Value)
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nodeError(file, item, "option %s values must be strings", key.Value), nil
+				}
+				values = append(values, item.Value)
+			}
+		default:
+			return nodeError(file, value, "option %s must be string or list", key.Value), nil
+		}
+		if len(values) == 0 || values[0] == "" {
+			return nodeError(file, value, "option %s must have value", key.Value), nil
+		}
+		options = append(options, key.Value+OptionSeparator+strings.Join(values, ListSeparator))
+	}
+	return nil, options
+}
+
+func nodeError(file string, node *yaml.Node, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	if node.Line == 0 {
+		return fmt.Errorf("%s", message)
+	}
+	return fmt.Errorf("%s:%d: %s", file, node.Line, message)
+}
+
+// Get the YAML nodes of the rules of the config file, used for the line numbers
+func loadRuleNodes(file string) (error, []*yaml.Node) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err, nil
+	}
+
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return err, nil
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		// Config keys are case insensitive
+		if strings.EqualFold(root.Content[i].Value, "ProxyRules") && root.Content[i+1].Kind == yaml.SequenceNode {
+			return nil, root.Content[i+1].Content
+		}
+	}
+	return nil, nil
+}
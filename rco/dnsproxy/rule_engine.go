@@ -2,9 +2,20 @@ package dnsproxy
 
 import (
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
-	"github.com/miekg/dns"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	// Flag of the rules regexp, queries are matched case insensitive
+	CaseInsensitiveRegexp = "(?i)"
+
+	// Rule modes, audit mode logs the Deny and Allow decisions without blocking
+	EnforceMode = "enforce"
+	AuditMode   = "audit"
 )
 
 const (
@@ -18,6 +29,7 @@ const (
 	RewriteType
 	AllowType
 	DenyType
+	AnswerType
 )
 
 const (
@@ -25,6 +37,10 @@ const (
 	SUFFIX
 	SUBSTRING
 	REGEXP
+	EXACT
+	DOMAIN
+	GLOB
+	SUBNET
 )
 
 var (
@@ -33,6 +49,10 @@ var (
 		"SUFFIX": SUFFIX,
 		"SUBSTRING": SUBSTRING,
 		"REGEXP": REGEXP,
+		"EXACT": EXACT,
+		"DOMAIN": DOMAIN,
+		"GLOB": GLOB,
+		"SUBNET": SUBNET,
 	}
 
 	RuleTypeMap = map[string]int8{
@@ -44,17 +64,32 @@ var (
 		"A": AllowType,
 		"DENY": DenyType,
 		"D": DenyType,
+		"ANSWER": AnswerType,
 	}
 )
 
 type Rule interface {
 	Parse([]string) error
 	Apply(string) (bool, string)
+	Options() *ruleOptions
 }
 
 type RuleEngine struct {
 	rules   map[int8][]Rule
 	scanAll bool
+
+	// Compiled Pass, Allow and enforced Deny rules
+	index map[int8]*ruleIndex
+	// Compiled Deny rules with the audit option
+	auditIndex *ruleIndex
+	// Audit mode of all the rules, set by the global mode
+	audit bool
+	// Allow rules are audited when all of them have the audit option
+	allowAudit bool
+	// All the rules in the config order
+	all []Rule
+	// Clock of the rule schedules
+	clock func() time.Time
 }
 
 func (re *RuleEngine) Name() string {
@@ -65,47 +100,145 @@ func (re *RuleEngine) SetScanAll(scanAll bool) {
 	re.scanAll = scanAll
 }
 
+// Set audit mode, Deny and Allow decisions of all the rules are logged without blocking
+func (re *RuleEngine) SetAudit(audit bool) {
+	re.audit = audit
+}
+
+// Set the clock the rule schedules are checked against
+func (re *RuleEngine) SetClock(clock func() time.Time) {
+	re.clock = clock
+}
+
 /*
 	Build new engine
 	Rule definition format:
 	RULETYPE ACTION FROM TO OPTIONS
  */
-func NewRuleEngine(rawRules []string) *RuleEngine {
+func NewRuleEngine(rawRules []string) (error, *RuleEngine) {
+	sources := make([]ruleSource, 0, len(rawRules))
+	for index, rr := range rawRules {
+		sources = append(sources, ruleSource{fields: strings.Fields(rr), position: strconv.Itoa(index)})
+	}
+	return compileRuleEngine(sources, nil)
+}
+
+/*
+	Build new engine from the fields of the rules, errors are reported with the rule position
+	Rules are referencing the named schedules by the schedule option.
+*/
+func compileRuleEngine(sources []ruleSource, schedules map[string]*Schedule) (error, *RuleEngine) {
 	engine := new(RuleEngine)
 	engine.rules = make(map[int8][]Rule)
+	engine.clock = time.Now
 
 	log.Info("Start compiling rulesEngine")
+	ids := make(map[string]bool)
 
 	// Compile every rule definition
-	for index, rr := range rawRules {
-		// Split all rulesEngine into fields and convert to UPPER case
-		fields := strings.Fields(strings.ToUpper(rr))
-		if !strings.HasSuffix(fields[PatternOffset], ".") {
-			fields[PatternOffset] += "."
+	for index, source := range sources {
+		// Type and action are case insensitive, patterns and replacements are kept as written
+		fields := append([]string(nil), source.fields...)
+		position := source.position
+		if len(fields) <= PatternOffset {
+			return fmt.Errorf("%s - rule must have at least %d fields", position, PatternOffset+1), nil
 		}
+		definition := strings.Join(fields, " ")
+		normalizeRuleFields(fields)
 		// Parse rulesEngine by type and add to the rule map
+		var rule Rule
 		switch fields[RuleTypeOffset] {
 			case "REWRITE", "RW":
 				if err, rw := NewRewriteRule(fields); err != nil {
-					log.Fatalf("%d - Failed to parse rewrite rule: %s", index, err)
+					return fmt.Errorf("%s - Failed to parse rewrite rule: %s", position, err), nil
+				} else {
+					rule = rw
+				}
+				break
+			case "ANSWER":
+				if err, r := NewAnswerRule(fields); err != nil {
+					return fmt.Errorf("%s - Failed to parse answer rule: %s", position, err), nil
 				} else {
-					engine.rules[RewriteType] = append(engine.rules[RewriteType], rw)
+					rule = r
 				}
 				break
 			case "PASS", "P", "ALLOW", "A", "DENY", "D":
 				if err, r := NewMatchingRule(fields); err != nil {
-					log.Fatalf("%d - Failed to parse rule: %s", index, err)
+					return fmt.Errorf("%s - Failed to parse rule: %s", position, err), nil
 				} else {
-					engine.rules[RuleTypeMap[fields[0]]] = append(engine.rules[RuleTypeMap[fields[0]]], r)
+					rule = r
 				}
 				break
 		default:
-			log.Fatalf("Unsupported rule type - \"%s\"in rule number %d", fields[0], index)
+			return fmt.Errorf("%s - unsupported rule type - \"%s\"", position, fields[0]), nil
+		}
+
+		// Rule ID is the name option or the index of the rule
+		options := rule.Options()
+		options.id = strconv.Itoa(index)
+		if options.Name != "" {
+			options.id = options.Name
+		}
+		if ids[options.id] {
+			return fmt.Errorf("%s - rule ID %s is not unique", position, options.id), nil
+		}
+		ids[options.id] = true
+		if options.scheduleName != "" {
+			schedule, ok := schedules[strings.ToLower(options.scheduleName)]
+			if !ok {
+				return fmt.Errorf("%s - schedule %s is not defined", position, options.scheduleName), nil
+			}
+			options.Schedule = schedule
+		}
+		options.ruleType = RuleTypeMap[fields[RuleTypeOffset]]
+		options.definition = definition
+		options.file = source.file
+		options.stats = new(ruleStats)
+
+		engine.rules[options.ruleType] = append(engine.rules[options.ruleType], rule)
+		engine.all = append(engine.all, rule)
+	}
+
+	// Index the matching and Answer rules, Rewrite rules are applied in order one by one
+	engine.index = make(map[int8]*ruleIndex)
+	for _, ruleType := range []int8{PassType, AllowType} {
+		engine.index[ruleType] = newRuleIndex(engine.rules[ruleType])
+	}
+	var denyRules, auditRules []Rule
+	for _, rule := range engine.rules[DenyType] {
+		if rule.Options().Audit {
+			auditRules = append(auditRules, rule)
+		} else {
+			denyRules = append(denyRules, rule)
 		}
 	}
+	engine.index[DenyType] = newRuleIndex(denyRules)
+	engine.index[AnswerType] = newRuleIndex(buildAnswerRules(engine.rules[AnswerType]))
+	engine.auditIndex = newRuleIndex(auditRules)
+
+	engine.allowAudit = len(engine.rules[AllowType]) > 0
+	for _, rule := range engine.rules[AllowType] {
+		engine.allowAudit = engine.allowAudit && rule.Options().Audit
+	}
 
 	log.Info("Compiling rulesEngine ended successfully")
-	return engine
+	return nil, engine
+}
+
+// Uppercase the type and action of the rule fields and add . suffix to the pattern of name ends
+func normalizeRuleFields(fields []string) {
+	fields[RuleTypeOffset] = strings.ToUpper(fields[RuleTypeOffset])
+	fields[ActionOffset] = strings.ToUpper(fields[ActionOffset])
+	// Prefix and substring patterns may end inside a label, regexp and subnet patterns are used as written
+	if action, ok := ActionMap[fields[ActionOffset]]; ok && hasNameEnd(action) &&
+		!strings.HasSuffix(fields[PatternOffset], ".") {
+		fields[PatternOffset] += "."
+	}
+}
+
+// Check if the patterns of the action are matched up to the end of the name
+func hasNameEnd(action int8) bool {
+	return action == SUFFIX || action == EXACT || action == DOMAIN || action == GLOB
 }
 
 func (re *RuleEngine) Apply(query *EngineQuery, metadata RequestMetadata) (*EngineQuery, error) {
@@ -114,53 +247,89 @@ func (re *RuleEngine) Apply(query *EngineQuery, metadata RequestMetadata) (*Engi
 	if len(query.Queries) <= 0 {
 		return nil, errors.New("can't get as input empty EngineQuery")
 	}
-	if query.Queries[0].Type != dns.TypeA && query.Queries[0].Type != dns.TypeAAAA {
-		return result, nil
-	}
-	rwResult, newQuery := re.applyImpl(query.Queries[0].Name)
+	rwResult, newQuery, rule := re.applyImpl(query.Queries[0], metadata)
 	result.Queries[0].Name = newQuery
-	result.Queries[0].Type = query.Queries[0].Type
 	result.Result = rwResult
 	result.dnsMsg = query.dnsMsg
+	if rwResult == BLOCKED && rule != nil {
+		result.Block = rule.Options().Block
+	}
+	if rwResult == ANSWERED {
+		result.dnsMsg, result.Target = re.answerMsg(query.dnsMsg, query.Queries[0], metadata, rule.(*AnswerRule))
+	}
+	if rwResult == AUDITED {
+		result.Result = ALLOWED
+		result.Audit = &AuditVerdict{RuleID: "-", RuleType: RuleTypeNames[AllowType], Rule: "no Allow rule matched"}
+		if rule != nil {
+			options := rule.Options()
+			result.Audit = &AuditVerdict{RuleID: options.id, RuleType: RuleTypeNames[options.ruleType], Rule: options.definition}
+		}
+	}
 
 	return result, nil
 }
 
-func (re *RuleEngine) applyImpl(query string) (int8, string) {
-	// Convert query into UPPER case to match all UPPER case rulesEngine
-	var newQuery = strings.ToUpper(query)
+/*
+	Apply the rules on the query, returns the result, the new query name and the rule that blocked the query
+	Rules are skipped when the query type, the client or the time doesn't match their options,
+	the Allow rules are enforced only when some of them are applied to the query type.
+	Queries that would have been blocked by audited rules are AUDITED, the rewrites are still applied.
+	Queries with local records are ANSWERED by the returned Answer rule.
+*/
+func (re *RuleEngine) applyImpl(query Query, metadata RequestMetadata) (int8, string, Rule) {
+	// Rules are matching case insensitive, the case of the query is kept
+	var newQuery = query.Name
+	now := re.clock()
+	result := ALLOWED
+	var auditRule Rule
 
 	// Apply Pass Rules
-	for _, mr := range re.rules[PassType] {
-		if pass, _ := mr.Apply(newQuery); pass {
-			return ALLOWED, query
-		}
+	if pr := re.index[PassType].match(newQuery, query, metadata, now); pr != nil {
+		pr.Options().stats.hit()
+		return ALLOWED, query.Name, nil
 	}
 
-	// Apply Allow Rules
-	var res = BLOCKED
-	for _, ar := range re.rules[AllowType] {
-		if allowed, _ := ar.Apply(newQuery); allowed {
-			res = ALLOWED
-			break
-		}
+	// Apply Answer Rules, local records are answered before the Allow and Deny rules
+	if ar := re.index[AnswerType].match(newQuery, query, metadata, now); ar != nil {
+		ar.Options().stats.hit()
+		return ANSWERED, query.Name, ar
 	}
 
-	if res == BLOCKED {
-		return BLOCKED, ""
+	// Apply Allow Rules
+	allowIndex := re.index[AllowType]
+	if allowIndex.applies(query, metadata, now) {
+		ar := allowIndex.match(newQuery, query, metadata, now)
+		if ar == nil && !re.audit && !re.allowAudit {
+			return BLOCKED, "", nil
+		} else if ar == nil {
+			result = AUDITED
+		} else {
+			ar.Options().stats.hit()
+		}
 	}
 
-	// Apply Deny Rules
-	for _, dr := range re.rules[DenyType] {
-		if denied, _ := dr.Apply(newQuery); denied {
-			return BLOCKED, ""
+	// Apply Deny Rules, audited rules are checked only when no rule blocks the query
+	if dr := re.index[DenyType].match(newQuery, query, metadata, now); dr != nil {
+		dr.Options().stats.hit()
+		if !re.audit {
+			return BLOCKED, "", dr
 		}
+		result, auditRule = AUDITED, dr
+	} else if dr := re.auditIndex.match(newQuery, query, metadata, now); dr != nil {
+		dr.Options().stats.hit()
+		result, auditRule = AUDITED, dr
 	}
 
 	// Apply rewrites Rules
 	for _, rw := range re.rules[RewriteType] {
+		if !rw.Options().match(query, metadata, now) {
+			continue
+		}
 		rewrite, result := rw.Apply(newQuery)
 		newQuery = result
+		if rewrite {
+			rw.Options().stats.hit()
+		}
 
 		// Exit rewrites if scanAll not sets and rewrite applied
 		if rewrite && !re.scanAll {
@@ -169,5 +338,5 @@ func (re *RuleEngine) applyImpl(query string) (int8, string) {
 	}
 
 	// If passed allow rulesEngine and not blocked by deny or change return ALLOWED with original string
-	return ALLOWED, newQuery
+	return result, newQuery, auditRule
 }
@@ -0,0 +1,182 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+)
+
+const (
+	HostsFormat   = "hosts"
+	DomainsFormat = "domains"
+	AdblockFormat = "adblock"
+
+	RuleFileTypeDefault = "Deny"
+)
+
+var (
+	// Rule types of the entries, the other rule types need more fields than the pattern
+	ruleFileTypes = map[string]bool{
+		"DENY":  true,
+		"D":     true,
+		"ALLOW": true,
+		"A":     true,
+		"PASS":  true,
+		"P":     true,
+	}
+
+	// Names of the local host in hosts files, they are not part of the list
+	hostsLocalNames = map[string]bool{
+		"localhost":             true,
+		"localhost.localdomain": true,
+		"local":                 true,
+		"broadcasthost":         true,
+		"ip6-localhost":         true,
+		"ip6-loopback":          true,
+		"ip6-localnet":          true,
+		"ip6-mcastprefix":       true,
+		"ip6-allnodes":          true,
+		"ip6-allrouters":        true,
+		"ip6-allhosts":          true,
+		"0.0.0.0":               true,
+	}
+)
+
+// External list of domains loaded as rules
+type RuleFileConfig struct {
+	Path    string `mapstructure:"Path"`
+	Format  string `mapstructure:"Format"`
+	Type    string `mapstructure:"Type"`
+	Options string `mapstructure:"Options"`
+}
+
+/*
+	Load the rule file and convert every entry to rule definition
+	hosts   - "IP NAME [NAME...]" lines, names are matched EXACT
+	domains - domain per line, the domain and its subdomains are matched
+	adblock - "||domain^" lines are Deny rules and "@@||domain^" exceptions are Pass rules
+	Lines that are not supported by the format are skipped.
+*/
+func LoadRuleFile(conf RuleFileConfig) (error, []string) {
+	file, err := os.Open(conf.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open rule file: %s", err), nil
+	}
+	defer file.Close()
+
+	ruleType := conf.Type
+	if ruleType == "" {
+		ruleType = RuleFileTypeDefault
+	}
+	if !ruleFileTypes[strings.ToUpper(ruleType)] {
+		return fmt.Errorf("rule file type must be Deny, Allow or Pass: %s", ruleType), nil
+	}
+
+	var parseLine func(string) []string
+	switch strings.ToLower(conf.Format) {
+	case HostsFormat:
+		parseLine = func(line string) []string {
+			return parseHostsLine(ruleType, line)
+		}
+	case DomainsFormat, "":
+		parseLine = func(line string) []string {
+			return parseDomainLine(ruleType, line)
+		}
+	case AdblockFormat:
+		parseLine = parseAdblockLine
+	default:
+		return fmt.Errorf("rule file format %s not supported", conf.Format), nil
+	}
+
+	var rules []string
+	skipped := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		lineRules := parseLine(line)
+		if lineRules == nil {
+			skipped++
+			continue
+		}
+		for _, rule := range lineRules {
+			rules = append(rules, strings.TrimSpace(rule+" "+conf.Options))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read rule file: %s", err), nil
+	}
+
+	if skipped > 0 {
+		log.Warningf("Skipped %d unsupported lines of rule file: %s", skipped, conf.Path)
+	}
+	log.Infof("Loaded %d rules from rule file: %s", len(rules), conf.Path)
+	return nil, rules
+}
+
+func parseHostsLine(ruleType string, line string) []string {
+	// Remove inline comment
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil
+	}
+
+	rules := []string{}
+	for _, name := range fields[1:] {
+		if hostsLocalNames[strings.ToLower(name)] {
+			continue
+		}
+		if !ValidateDNSFormat(strings.TrimSuffix(name, ".")) {
+			return nil
+		}
+		rules = append(rules, fmt.Sprintf("%s EXACT %s", ruleType, name))
+	}
+	return rules
+}
+
+func parseDomainLine(ruleType string, line string) []string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	domain := strings.TrimPrefix(line, "*.")
+	if !ValidateDNSFormat(strings.TrimSuffix(domain, ".")) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s DOMAIN %s", ruleType, domain)}
+}
+
+/*
+	Only the domain rules "||domain^" are supported, rules with modifiers other than $important are skipped
+	Exceptions are Pass rules and not Allow rules, Allow rule would turn on the Whitelist and drop the queries of the other domains.
+	Pass rules are applied before all the other rules, so the exceptions skip the Answer and Rewrite rules of the config too.
+*/
+func parseAdblockLine(line string) []string {
+	ruleType := "Deny"
+	if strings.HasPrefix(line, "@@") {
+		ruleType = "Pass"
+		line = line[2:]
+	}
+	if i := strings.Index(line, "$"); i >= 0 {
+		if line[i+1:] != "important" {
+			return nil
+		}
+		line = line[:i]
+	}
+	if !strings.HasPrefix(line, "||") || !strings.HasSuffix(line, "^") {
+		return nil
+	}
+
+	domain := line[2 : len(line)-1]
+	if !ValidateDNSFormat(domain) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s DOMAIN %s", ruleType, domain)}
+}
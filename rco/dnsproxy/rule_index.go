@@ -0,0 +1,164 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Index of rules of the same type, compiled for lookup that doesn't scan all the rules
+	PREFIX        - radix trie of the patterns
+	SUFFIX, DOMAIN, EXACT - radix trie of the reversed patterns
+	SUBSTRING     - Aho-Corasick automaton of the patterns
+	REGEXP        - combined regexp, the rules are checked only when one of them matches
+	Other rules are checked one by one.
+	The first matching rule by the config order is returned, same as scanning the rules in order.
+*/
+type ruleIndex struct {
+	rules []Rule
+
+	prefixes   radixTrie
+	suffixes   radixTrie
+	substrings *ahoCorasick
+	regexps    []int
+	anyRegexp  *regexp.Regexp
+	others     []int
+
+	// Distinct options of the rules, used to check if any rule is applied to the query
+	optionSets []*ruleOptions
+}
+
+func newRuleIndex(rules []Rule) *ruleIndex {
+	ix := &ruleIndex{rules: rules, substrings: newAhoCorasick()}
+	optionKeys := make(map[string]bool)
+	var regexpPatterns []string
+
+	for i, rule := range rules {
+		options := rule.Options()
+		key := optionsKey(options)
+		if !optionKeys[key] {
+			optionKeys[key] = true
+			ix.optionSets = append(ix.optionSets, options)
+		}
+
+		mr, ok := indexedMatcher(rule)
+		if !ok {
+			ix.others = append(ix.others, i)
+			continue
+		}
+		pattern := strings.ToLower(mr.Pattern)
+		switch mr.Action {
+		case PREFIX:
+			ix.prefixes.insert(pattern, trieEntry{index: i, kind: matchAnyKind})
+		case SUFFIX:
+			ix.suffixes.insert(reverseString(pattern), trieEntry{index: i, kind: matchAnyKind})
+		case DOMAIN:
+			ix.suffixes.insert(reverseString(pattern), trieEntry{index: i, kind: matchLabelKind})
+		case EXACT:
+			ix.suffixes.insert(reverseString(pattern), trieEntry{index: i, kind: matchExactKind})
+		case SUBSTRING:
+			ix.substrings.add(pattern, i)
+		case REGEXP:
+			ix.regexps = append(ix.regexps, i)
+			regexpPatterns = append(regexpPatterns, "(?:"+mr.Pattern+")")
+		default:
+			ix.others = append(ix.others, i)
+		}
+	}
+	ix.substrings.build()
+
+	// Rules are checked one by one when the patterns can't be combined
+	if len(regexpPatterns) > 0 {
+		if combined, err := regexp.Compile(CaseInsensitiveRegexp + strings.Join(regexpPatterns, "|")); err == nil {
+			ix.anyRegexp = combined
+		}
+	}
+
+	return ix
+}
+
+// Key of the options the index checks, equal options of different rules have the same key
+func optionsKey(options *ruleOptions) string {
+	clients := make([]string, 0, len(options.Clients))
+	for _, client := range options.Clients {
+		clients = append(clients, client.String())
+	}
+	return fmt.Sprintf("%v|%v|%v|%p", options.Types, options.Regions, clients, options.Schedule)
+}
+
+// Check if any of the rules is applied to the query by its options
+func (ix *ruleIndex) applies(query Query, metadata RequestMetadata, now time.Time) bool {
+	for _, options := range ix.optionSets {
+		if options.match(query, metadata, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the first rule by order that matches the name and is applied to the query
+func (ix *ruleIndex) match(name string, query Query, metadata RequestMetadata, now time.Time) Rule {
+	best := len(ix.rules)
+	candidate := func(i int) {
+		if i < best && ix.rules[i].Options().match(query, metadata, now) {
+			best = i
+		}
+	}
+
+	lowerName := strings.ToLower(name)
+	ix.prefixes.walk(lowerName, func(entry trieEntry) {
+		candidate(entry.index)
+	})
+	ix.suffixes.walk(reverseString(lowerName), func(entry trieEntry) {
+		candidate(entry.index)
+	})
+	ix.substrings.search(lowerName, candidate)
+
+	// Rules that are not indexed are checked only when they are before the best match
+	linear := ix.others
+	if ix.anyRegexp == nil || ix.anyRegexp.MatchString(name) {
+		linear = mergeSorted(linear, ix.regexps)
+	}
+	for _, i := range linear {
+		if i >= best {
+			break
+		}
+		if ix.rules[i].Options().match(query, metadata, now) {
+			if matched, _ := ix.rules[i].Apply(name); matched {
+				best = i
+				break
+			}
+		}
+	}
+
+	if best == len(ix.rules) {
+		return nil
+	}
+	return ix.rules[best]
+}
+
+// Get the matching rule the rule is indexed by
+func indexedMatcher(rule Rule) (*MatchingRule, bool) {
+	switch r := rule.(type) {
+	case *MatchingRule:
+		return r, true
+	case *AnswerRule:
+		return r.matcher, true
+	}
+	return nil, false
+}
+
+func mergeSorted(a []int, b []int) []int {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	merged := append(append(make([]int, 0, len(a)+len(b)), a...), b...)
+	sort.Ints(merged)
+	return merged
+}
@@ -0,0 +1,186 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OptionSeparator = "="
+	ListSeparator   = ","
+	AnyValue        = "*"
+
+	BlockOption   = "BLOCK"
+	TypesOption   = "TYPES"
+	RegionsOption = "REGIONS"
+	ClientsOption = "CLIENTS"
+	NameOption     = "NAME"
+	ScheduleOption = "SCHEDULE"
+	AuditOption    = "AUDIT"
+)
+
+var (
+	// Query types the rules are applied to when types option is not set
+	DefaultRuleTypes = map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true}
+)
+
+// Options shared by all rule types
+type ruleOptions struct {
+	Block *BlockResponse
+	// Query types the rule is applied to, nil is any type
+	Types map[uint16]bool
+	// Client regions and networks the rule is applied to, nil is any client
+	Regions map[string]bool
+	Clients []*net.IPNet
+	// Name used as the rule ID
+	Name string
+	// Time windows the rule is active in, nil is always active
+	Schedule *Schedule
+	// Named schedule of the config, resolved by the engine
+	scheduleName string
+	// Log the Deny or Allow decision without blocking the query
+	Audit bool
+
+	// Set by the engine when the rule is compiled
+	id         string
+	ruleType   int8
+	definition string
+	file       string
+	stats      *ruleStats
+}
+
+/*
+	Parse the OPTIONS fields of the rule
+	Every option must be in the format: KEY=VALUE, keys are case insensitive
+*/
+func parseRuleOptions(ruleType int8, fields []string) (error, ruleOptions) {
+	options := ruleOptions{Types: DefaultRuleTypes}
+
+	for _, field := range fields {
+		kv := strings.SplitN(field, OptionSeparator, 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("option must be in KEY=VALUE format: %s", field), options
+		}
+
+		switch key, value := strings.ToUpper(kv[0]), kv[1]; key {
+		case BlockOption:
+			if ruleType != DenyType {
+				return fmt.Errorf("option %s supported only by Deny rules", kv[0]), options
+			}
+			err, block := NewBlockResponse(value)
+			if err != nil {
+				return err, options
+			}
+			options.Block = block
+		case TypesOption:
+			err, types := parseQueryTypes(value)
+			if err != nil {
+				return err, options
+			}
+			options.Types = types
+		case RegionsOption:
+			options.Regions = make(map[string]bool)
+			for _, region := range strings.Split(value, ListSeparator) {
+				options.Regions[strings.ToLower(region)] = true
+			}
+		case NameOption:
+			options.Name = value
+		case ScheduleOption:
+			// Named schedules are resolved when all the rules are compiled
+			if !strings.ContainsAny(value, DaysSeparator+":") {
+				options.scheduleName = value
+				break
+			}
+			err, schedule := NewSchedule(value, "")
+			if err != nil {
+				return err, options
+			}
+			options.Schedule = schedule
+		case AuditOption:
+			if ruleType != DenyType && ruleType != AllowType {
+				return fmt.Errorf("option %s supported only by Deny and Allow rules", kv[0]), options
+			}
+			audit, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("option %s must be true or false: %s", kv[0], value), options
+			}
+			options.Audit = audit
+		case ClientsOption:
+			err, clients := parseClientNetworks(value)
+			if err != nil {
+				return err, options
+			}
+			options.Clients = clients
+		default:
+			return fmt.Errorf("unknown option %s", kv[0]), options
+		}
+	}
+
+	return nil, options
+}
+
+// Parse comma separated list of query types, * is any type
+func parseQueryTypes(value string) (error, map[uint16]bool) {
+	if value == AnyValue {
+		return nil, nil
+	}
+
+	types := make(map[uint16]bool)
+	for _, name := range strings.Split(value, ListSeparator) {
+		qtype, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return fmt.Errorf("unknown query type %s", name), nil
+		}
+		types[qtype] = true
+	}
+	return nil, types
+}
+
+// Parse comma separated list of IP Addresses and Subnets
+func parseClientNetworks(value string) (error, []*net.IPNet) {
+	var networks []*net.IPNet
+	for _, client := range strings.Split(value, ListSeparator) {
+		if !strings.Contains(client, "/") {
+			if ip := net.ParseIP(client); ip != nil && ip.To4() != nil {
+				client += "/32"
+			} else {
+				client += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return fmt.Errorf("client must be valid IP Address or Subnet: %s", client), nil
+		}
+		networks = append(networks, network)
+	}
+	return nil, networks
+}
+
+/*
+	Check if the rule is applied to the query of the client at the time
+	Every option set must match, the values of the same option are alternatives.
+*/
+func (o *ruleOptions) match(query Query, metadata RequestMetadata, now time.Time) bool {
+	if o.Types != nil && !o.Types[query.Type] {
+		return false
+	}
+	if o.Schedule != nil && !o.Schedule.active(now) {
+		return false
+	}
+	if o.Regions != nil && !o.Regions[strings.ToLower(metadata.Region)] {
+		return false
+	}
+	if o.Clients != nil {
+		for _, network := range o.Clients {
+			if network.Contains(metadata.IP) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
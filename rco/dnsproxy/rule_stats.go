@@ -0,0 +1,156 @@
+package dnsproxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	RuleTypeNames = map[int8]string{
+		PassType:    "Pass",
+		RewriteType: "Rewrite",
+		AllowType:   "Allow",
+		DenyType:    "Deny",
+		AnswerType:  "Answer",
+	}
+
+	ruleHitsDesc = prometheus.NewDesc(
+		"hoopoe_rule_hits_total",
+		"Number of queries the rule was applied to",
+		[]string{"rule_id", "type"}, nil,
+	)
+	ruleLastHitDesc = prometheus.NewDesc(
+		"hoopoe_rule_last_hit_timestamp_seconds",
+		"Unix time of the last query the rule was applied to",
+		[]string{"rule_id", "type"}, nil,
+	)
+	ruleFileHitsDesc = prometheus.NewDesc(
+		"hoopoe_rule_file_hits_total",
+		"Number of queries the rules of the rule file were applied to",
+		[]string{"file", "type"}, nil,
+	)
+	ruleFileLastHitDesc = prometheus.NewDesc(
+		"hoopoe_rule_file_last_hit_timestamp_seconds",
+		"Unix time of the last query the rules of the rule file were applied to",
+		[]string{"file", "type"}, nil,
+	)
+)
+
+// Hit counters of single rule, updated concurrently by the queries
+type ruleStats struct {
+	hits    uint64
+	lastHit int64
+}
+
+func (s *ruleStats) hit() {
+	atomic.AddUint64(&s.hits, 1)
+	atomic.StoreInt64(&s.lastHit, time.Now().UnixNano())
+}
+
+// Rule hits as returned by the rules HTTP endpoint
+type RuleStatus struct {
+	ID      string     `json:"id"`
+	Type    string     `json:"type"`
+	Rule    string     `json:"rule"`
+	Hits    uint64     `json:"hits"`
+	LastHit *time.Time `json:"last_hit,omitempty"`
+	Audit   bool       `json:"audit,omitempty"`
+	File    string     `json:"file,omitempty"`
+}
+
+// Get the hits of all the rules in the config order
+func (re *RuleEngine) Status() []RuleStatus {
+	status := make([]RuleStatus, 0, len(re.all))
+	for _, rule := range re.all {
+		options := rule.Options()
+		rs := RuleStatus{
+			ID:    options.id,
+			Type:  RuleTypeNames[options.ruleType],
+			Rule:  options.definition,
+			Hits:  atomic.LoadUint64(&options.stats.hits),
+			Audit: options.Audit || (re.audit && (options.ruleType == DenyType || options.ruleType == AllowType)),
+			File:  options.file,
+		}
+		if lastHit := atomic.LoadInt64(&options.stats.lastHit); lastHit != 0 {
+			t := time.Unix(0, lastHit)
+			rs.LastHit = &t
+		}
+		status = append(status, rs)
+	}
+	return status
+}
+
+// Keep the hits of the rules that didn't change since the previous engine
+func (re *RuleEngine) InheritStats(previous *RuleEngine) {
+	if previous == nil {
+		return
+	}
+	stats := make(map[string]*ruleOptions, len(previous.all))
+	for _, rule := range previous.all {
+		stats[rule.Options().id] = rule.Options()
+	}
+	for _, rule := range re.all {
+		options := rule.Options()
+		if old, ok := stats[options.id]; ok && old.definition == options.definition {
+			options.stats = old.stats
+		}
+	}
+}
+
+/*
+	Prometheus collector of the rule hits, the rules are read on every scrape
+	Rules of the rule files are summed per file and type, the rule files can have hundreds of thousands of rules.
+*/
+type ruleCollector struct {
+	status func() []RuleStatus
+}
+
+// Hits of the rules of single rule file and type
+type ruleFileHits struct {
+	file     string
+	ruleType string
+	hits     uint64
+	lastHit  *time.Time
+}
+
+func (c *ruleCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ruleHitsDesc
+	ch <- ruleLastHitDesc
+	ch <- ruleFileHitsDesc
+	ch <- ruleFileLastHitDesc
+}
+
+func (c *ruleCollector) Collect(ch chan<- prometheus.Metric) {
+	var files []*ruleFileHits
+	fileIndex := make(map[string]*ruleFileHits)
+	for _, rs := range c.status() {
+		if rs.File != "" {
+			key := rs.File + "|" + rs.Type
+			fh, ok := fileIndex[key]
+			if !ok {
+				fh = &ruleFileHits{file: rs.File, ruleType: rs.Type}
+				fileIndex[key] = fh
+				files = append(files, fh)
+			}
+			fh.hits += rs.Hits
+			if rs.LastHit != nil && (fh.lastHit == nil || rs.LastHit.After(*fh.lastHit)) {
+				fh.lastHit = rs.LastHit
+			}
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(ruleHitsDesc, prometheus.CounterValue, float64(rs.Hits), rs.ID, rs.Type)
+		if rs.LastHit != nil {
+			ch <- prometheus.MustNewConstMetric(ruleLastHitDesc, prometheus.GaugeValue,
+				float64(rs.LastHit.UnixNano())/float64(time.Second), rs.ID, rs.Type)
+		}
+	}
+
+	for _, fh := range files {
+		ch <- prometheus.MustNewConstMetric(ruleFileHitsDesc, prometheus.CounterValue, float64(fh.hits), fh.file, fh.ruleType)
+		if fh.lastHit != nil {
+			ch <- prometheus.MustNewConstMetric(ruleFileLastHitDesc, prometheus.GaugeValue,
+				float64(fh.lastHit.UnixNano())/float64(time.Second), fh.file, fh.ruleType)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	WindowSeparator   = ","
+	TimezoneSeparator = "@"
+	DaysSeparator     = "/"
+)
+
+var (
+	WeekdayMap = map[string]time.Weekday{
+		"SUN": time.Sunday,
+		"MON": time.Monday,
+		"TUE": time.Tuesday,
+		"WED": time.Wednesday,
+		"THU": time.Thursday,
+		"FRI": time.Friday,
+		"SAT": time.Saturday,
+	}
+)
+
+// Named schedule defined in the config
+type ScheduleConfig struct {
+	Windows  []string `mapstructure:"Windows"`
+	Timezone string   `mapstructure:"Timezone"`
+}
+
+// Time windows a rule is active in
+type Schedule struct {
+	windows  []timeWindow
+	location *time.Location
+}
+
+type timeWindow struct {
+	days [7]bool
+	// Minutes from midnight, end before start is window that ends on the next day
+	start int
+	end   int
+}
+
+/*
+	Parse schedule definition
+	Format: WINDOW[,WINDOW...][@TIMEZONE]
+	Window: [DAYS/]HH:MM-HH:MM, days are single day (mon), range (mon-fri) or * for every day
+	Timezone is IANA time zone name, default is the timezone argument or local time.
+*/
+func NewSchedule(definition string, timezone string) (error, *Schedule) {
+	windows := definition
+	if i := strings.LastIndex(definition, TimezoneSeparator); i >= 0 {
+		windows, timezone = definition[:i], definition[i+1:]
+	}
+
+	s := &Schedule{location: time.Local}
+	if timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return fmt.Errorf("invalid schedule timezone %s: %s", timezone, err), nil
+		}
+		s.location = location
+	}
+
+	for _, window := range strings.Split(windows, WindowSeparator) {
+		err, w := parseTimeWindow(strings.TrimSpace(window))
+		if err != nil {
+			return err, nil
+		}
+		s.windows = append(s.windows, w)
+	}
+
+	return nil, s
+}
+
+func parseTimeWindow(window string) (error, timeWindow) {
+	var w timeWindow
+	days, hours := "*", window
+	if i := strings.Index(window, DaysSeparator); i >= 0 {
+		days, hours = window[:i], window[i+1:]
+	}
+
+	if days == AnyValue {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else {
+		first, last := days, days
+		if i := strings.Index(days, "-"); i >= 0 {
+			first, last = days[:i], days[i+1:]
+		}
+		from, ok := WeekdayMap[strings.ToUpper(first)]
+		to, ok2 := WeekdayMap[strings.ToUpper(last)]
+		if !ok || !ok2 {
+			return fmt.Errorf("invalid schedule days: %s", days), w
+		}
+		// Ranges can wrap the end of the week: fri-mon
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	bounds := strings.Split(hours, "-")
+	if len(bounds) != 2 {
+		return fmt.Errorf("schedule hours must be in HH:MM-HH:MM format: %s", hours), w
+	}
+	for i, bound := range bounds {
+		t, err := time.Parse("15:04", bound)
+		if err != nil {
+			return fmt.Errorf("schedule hours must be in HH:MM-HH:MM format: %s", hours), w
+		}
+		if i == 0 {
+			w.start = t.Hour()*60 + t.Minute()
+		} else {
+			w.end = t.Hour()*60 + t.Minute()
+		}
+	}
+
+	return nil, w
+}
+
+// Check if the time is inside one of the schedule windows
+func (s *Schedule) active(now time.Time) bool {
+	local := now.In(s.location)
+	minutes := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	yesterday := (day + 6) % 7
+
+	for _, w := range s.windows {
+		if w.start <= w.end {
+			if w.days[day] && minutes >= w.start && minutes < w.end {
+				return true
+			}
+		} else if (w.days[day] && minutes >= w.start) || (w.days[yesterday] && minutes < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse the named schedules of the config, names are case insensitive
+func NewSchedules(conf map[string]ScheduleConfig) (error, map[string]*Schedule) {
+	schedules := make(map[string]*Schedule)
+	for name, sc := range conf {
+		err, schedule := NewSchedule(strings.Join(sc.Windows, WindowSeparator), sc.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid schedule %s: %s", name, err), nil
+		}
+		schedules[strings.ToLower(name)] = schedule
+	}
+	return nil, schedules
+}
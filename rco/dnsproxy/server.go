@@ -1,11 +1,16 @@
 package dnsproxy
 
 import (
+	"context"
 	"github.com/armon/go-metrics"
+	"github.com/fsnotify/fsnotify"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,15 +23,27 @@ func handleError(e error, ln int) {
 
 var globalConfig = Config{}
 
+const (
+	// Max number of CNAME targets resolved for single question, stops loops of the Answer and TARGET rules
+	MaxTargetDepth = 8
+)
+
 // Proxy server implementation
 type DNSProxy struct {
-	accessLog *log.Logger
-	telemetry *TelemetryServer
-	server    *dns.Server
-
-	engines		   []Engine
-	usManager      *UpstreamsManager
-	regionMap      RegionMap
+	accessLog     *log.Logger
+	accessLogFile *os.File
+	telemetry     *TelemetryServer
+	servers       []*dns.Server
+	doh           *DoHServer
+
+	drainTimeout time.Duration
+	shutdownOnce sync.Once
+
+	// Current proxyState, replaced on reload
+	state      atomic.Value
+	configPath string
+	reloadLock sync.Mutex
+	watcher    *fsnotify.Watcher
 }
 
 func NewDNSProxy(configPath string) *DNSProxy {
@@ -40,28 +57,38 @@ func NewDNSProxy(configPath string) *DNSProxy {
 func (d *DNSProxy) Init(confPath string) {
 	var err error
 	// Load the config from json file
+	d.configPath = confPath
 	globalConfig = BuildConfig(confPath)
+	if d.drainTimeout, err = time.ParseDuration(globalConfig.DrainTimeout); err != nil {
+		log.Fatalf("Failed to parse DrainTimeout: %s", err)
+	}
 
-	// Load Region Map
-	if err, d.regionMap = NewRegionMap(globalConfig.ClientMapFile); err != nil {
+	// Client map is skipped on startup when it's not valid
+	if err, _ = NewRegionMap(globalConfig.ClientMapFile); err != nil {
 		log.Errorf("Failed to open client map file: %s, message: %s", globalConfig.ClientMapFile, err)
 		log.Warning("Skipping Client map configuration")
+		globalConfig.ClientMapFile = ""
 	}
 
 	// Load all engines and managers
-	rulesEngine := NewRuleEngine(globalConfig.Rules)
-	rulesEngine.SetScanAll(globalConfig.ScanAll)
-	d.engines = append(d.engines, NewRuleEngine(globalConfig.Rules))
-	d.engines = append(d.engines, NewTemplateEngine())
-	d.usManager = NewUpstreamsManager(
-		globalConfig.RemoteHosts,
-		globalConfig.LBType,
-		&d.regionMap,
-		globalConfig.UpstreamTimeout,
-	)
+	err, state := newProxyState(globalConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d.state.Store(state)
+
+	// Watch config files for changes
+	if globalConfig.WatchConfig {
+		if err = d.watchConfig(); err != nil {
+			log.Errorf("Failed to watch config files: %s", err)
+		}
+	}
 
 	// Init Telemetry
 	d.telemetry = NewTelemetryServer(&globalConfig.Telemetry)
+	d.telemetry.SetRulesStatus(func() []RuleStatus {
+		return d.currentState().rules.Status()
+	})
 
 	// Enable Access Log
 	if globalConfig.AccessLog {
@@ -69,6 +96,7 @@ func (d *DNSProxy) Init(confPath string) {
 		file, err := os.OpenFile(globalConfig.AccessLogPath, os.O_CREATE|os.O_WRONLY, 0666)
 		if err == nil {
 			d.accessLog.Out = file
+			d.accessLogFile = file
 		} else {
 			log.Errorf("Failed to open log file: %s", globalConfig.AccessLogPath)
 		}
@@ -79,23 +107,155 @@ func (d *DNSProxy) Init(confPath string) {
 func (d *DNSProxy) ListenAndServe() error {
 	// Set handlers
 	mux := dns.NewServeMux()
-	mux.HandleFunc("arpa.", d.handlePtr)
 	mux.HandleFunc(".", d.handleQuery)
-
-	// Build the DNS server
-	d.server = &dns.Server{Addr: globalConfig.LocalAddress, Net: "udp", Handler: mux}
+	if err := d.buildServers(d.formatErrorHandler(mux)); err != nil {
+		return err
+	}
 
 	// Start telemetry server, will exit immediately if telemetry is disabled
 	go d.telemetry.ListenAndServe()
 	log.Infof("Starting Telemetry, listening on: %s", globalConfig.Telemetry.Address)
 
-	log.Infof("Starting server, listening on: %s", globalConfig.LocalAddress)
+	// Start the DNS servers, the first server to stop will stop the others as well
+	errs := make(chan error, len(d.servers)+1)
+	for _, srv := range d.servers {
+		log.Infof("Starting server, listening on: %s/%s", srv.Addr, srv.Net)
+		go func(srv *dns.Server) {
+			errs <- srv.ListenAndServe()
+		}(srv)
+	}
+	if d.doh != nil {
+		log.Infof("Starting DoH server, listening on: https://%s%s", globalConfig.DoH.Address, DoHPath)
+		go func() {
+			errs <- d.doh.ListenAndServe()
+		}()
+	}
+
+	err := <-errs
+	d.Shutdown()
+	return err
+}
+
+// Build the DNS servers of the config, UDP and TCP are sharing the same address
+func (d *DNSProxy) buildServers(handler dns.Handler) error {
+	d.servers = []*dns.Server{
+		{Addr: globalConfig.LocalAddress, Net: "udp", Handler: handler, MsgAcceptFunc: acceptMsg},
+		{Addr: globalConfig.LocalAddress, Net: "tcp", Handler: handler, MsgAcceptFunc: acceptMsg},
+	}
+
+	// Add DNS-over-TLS server when configured
+	if globalConfig.DoT.Enabled {
+		err, tlsConfig := NewServerTLSConfig(globalConfig.DoT.CertFile, globalConfig.DoT.KeyFile)
+		if err != nil {
+			return err
+		}
+		d.servers = append(d.servers, &dns.Server{
+			Addr:      globalConfig.DoT.ListenAddress(globalConfig.LocalAddress),
+			Net:       "tcp-tls",
+			TLSConfig:     tlsConfig,
+			Handler:       handler,
+			MsgAcceptFunc: acceptMsg,
+		})
+	}
+
+	// Build DNS-over-HTTPS server when configured
+	if globalConfig.DoH.Enabled {
+		var err error
+		if err, d.doh = NewDoHServer(&globalConfig.DoH, handler); err != nil {
+			return err
+		}
+	}
 
-	// Start the DNS server
-	return d.server.ListenAndServe()
+	return nil
 }
 
-// handle Query requests that are not PTR
+/*
+	Gracefully stop the proxy
+	Stop accepting new queries and wait up to DrainTimeout for the in-flight queries,
+	then close the upstream connections, the access log and the telemetry server.
+	Safe to call multiple times, the later calls are waiting for the first one to finish.
+*/
+func (d *DNSProxy) Shutdown() {
+	d.shutdownOnce.Do(func() {
+		log.Infof("Shutting down, draining in-flight queries for up to %s", d.drainTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), d.drainTimeout)
+		defer cancel()
+
+		if d.watcher != nil {
+			handleError(d.watcher.Close(), 166)
+		}
+		d.shutdownServers(ctx)
+		d.currentState().usManager.Close()
+
+		// Flush and close the access log
+		if d.accessLogFile != nil {
+			handleError(d.accessLogFile.Sync(), 172)
+			handleError(d.accessLogFile.Close(), 173)
+		}
+
+		handleError(d.telemetry.Shutdown(ctx), 176)
+		log.Info("Shutdown completed")
+	})
+}
+
+// Stop all the DNS servers and wait for in-flight queries, servers that are already stopped are ignored
+func (d *DNSProxy) shutdownServers(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, srv := range d.servers {
+		wg.Add(1)
+		go func(srv *dns.Server) {
+			defer wg.Done()
+			if err := srv.ShutdownContext(ctx); err != nil {
+				log.Debugf("Server %s/%s shutdown: %s", srv.Addr, srv.Net, err)
+			}
+		}(srv)
+	}
+	if d.doh != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handleError(d.doh.Shutdown(ctx), 152)
+		}()
+	}
+	wg.Wait()
+}
+
+// Accept messages with multiple questions, messages without questions are rejected with FORMERR
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Qdcount > 1 {
+		dh.Qdcount = 1
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// Reply FORMERR to messages without questions, other messages are passed to the handler
+func (d *DNSProxy) formatErrorHandler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(resp dns.ResponseWriter, req *dns.Msg) {
+		if len(req.Question) == 0 {
+			respMsg := new(dns.Msg)
+			respMsg.SetRcode(req, dns.RcodeFormatError)
+			handleError(resp.WriteMsg(respMsg), 226)
+			return
+		}
+		next.ServeDNS(resp, req)
+	})
+}
+
+// Write the response to the client, UDP responses are truncated to the client buffer size
+func (d *DNSProxy) writeResponse(resp dns.ResponseWriter, req *dns.Msg, respMsg *dns.Msg) error {
+	if _, isUDP := resp.RemoteAddr().(*net.UDPAddr); isUDP {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		// Truncate will set the TC bit so the client will retry over TCP
+		respMsg.Truncate(size)
+	}
+
+	return resp.WriteMsg(respMsg)
+}
+
+// handle Query requests, PTR queries are processed by the same Engines
 func (d *DNSProxy) handleQuery(resp dns.ResponseWriter, req *dns.Msg) {
 	// Log the latency of the upstream servers
 	if globalConfig.Telemetry.Enabled {
@@ -104,115 +264,246 @@ func (d *DNSProxy) handleQuery(resp dns.ResponseWriter, req *dns.Msg) {
 
 	// Access Log
 	if globalConfig.AccessLog {
-		d.accessLog.Infof("%s Access Record %s", resp.RemoteAddr().String(), req.Question[0].String())
+		for _, question := range req.Question {
+			d.accessLog.Infof("%s Access Record %s", resp.RemoteAddr().String(), question.String())
+		}
 	}
 
-	// Copy the message for applying rulesEngine on it
-	reply, err := d.processMsg(resp, req)
-	handleError(err, 107)
-	if reply == nil {
-		d.returnBlocked(resp, req)
-	} else {
-		respMsg := d.buildResponseMsg(req, reply.dnsMsg)
-		err = resp.WriteMsg(respMsg)
-		handleError(err, 114)
-	}
-}
+	state := d.currentState()
+	metadata := NewRequestMetadata(&state.regionMap, resp.RemoteAddr())
 
-// process message by applying Engines
-func (d *DNSProxy) processMsg(resp dns.ResponseWriter, req *dns.Msg) (*EngineQuery, error) {
-	// Copy the message for applying rulesEngine on it
-	upstreamMsg := new(dns.Msg)
-	req.CopyTo(upstreamMsg)
-	upstreamMsg.Question = []dns.Question{}
-	metadata := RequestMetadata{
-		Region: d.regionMap.GetRegion(strings.Split(resp.RemoteAddr().String(), ":")[0]),
-		IPAddress: resp.RemoteAddr().String(),
+	// Every question is processed on its own and the answers are merged into one response
+	respMsg := new(dns.Msg)
+	respMsg.SetReply(req)
+	// SetReply copies only the first question
+	respMsg.Question = append([]dns.Question(nil), req.Question...)
+	for i, question := range req.Question {
+		reply, err := d.processMsg(state, resp, req, question, metadata, 0)
+		handleError(err, 107)
+		if reply == nil {
+			// Engine or all the upstream servers failed
+			mergeRcode(respMsg, dns.RcodeServerFailure)
+		} else if reply.Result == BLOCKED {
+			block := reply.Block
+			if block == nil {
+				block = state.blockResponse
+			}
+			block.answer(respMsg, question)
+			d.resolveBlockTarget(state, respMsg, req, question, block, metadata)
+		} else {
+			d.mergeResponseMsg(respMsg, req, question, reply, i == 0)
+		}
 	}
 
-	// Only one question supported
-	query := req.Question[0]
+	setResponseEdns(respMsg, req)
+	err := d.writeResponse(resp, req, respMsg)
+	handleError(err, 114)
+}
+
+// process single question of the message by applying Engines, depth is the number of CNAME targets resolved before the question
+func (d *DNSProxy) processMsg(state *proxyState, resp dns.ResponseWriter, req *dns.Msg, question dns.Question, metadata RequestMetadata, depth int) (*EngineQuery, error) {
 	engineQuery := new(EngineQuery)
 	engineQuery.dnsMsg = req
 	engineQuery.Queries = append(
 		engineQuery.Queries, Query{
-			Name: query.Name,
-			Type: query.Qtype,
+			Name:  question.Name,
+			Type:  question.Qtype,
+			Class: question.Qclass,
 		})
 	// Run on each registered Engine
-	for _, engine := range d.engines {
+	for _, engine := range state.engines {
 		// Process query with current Engine
 		engineQuery, err := engine.Apply(engineQuery, metadata)
 		if err != nil {
 			return nil, err
 		}
+		// Queries that would have been blocked in audit mode are logged and resolved
+		if engineQuery.Audit != nil {
+			d.logAudit(engine, resp, question, engineQuery.Audit)
+		}
+		// Local records are answered without the other engines and the upstream servers
+		if engineQuery.Result == ANSWERED {
+			return d.resolveAnswerTarget(state, resp, req, question, engineQuery, metadata, depth), nil
+		}
 		// Check if engine return that this query need to be blocked
 		if engineQuery.Result == BLOCKED {
 			// Access Log
 			if globalConfig.AccessLog {
 				d.accessLog.Infof(
-					"%s: BLOCKED - Record %s",
+					"%s: %s BLOCKED - Record %s",
 					engine.Name(),
 					resp.RemoteAddr().String(),
-					req.Question[0].String(),
+					question.String(),
 				)
 			}
-			return nil, nil
+			return engineQuery, nil
 		}
 	}
 
-	engineQuery, err := d.usManager.Apply(engineQuery, metadata)
+	engineQuery, err := state.usManager.Apply(engineQuery, metadata)
 	if err != nil {
 		return nil, err
 	}
 
-	return engineQuery, nil
+	// Rewrite the records of the upstream reply, rewritten CNAME target is resolved like local CNAME target
+	engineQuery, err = state.responses.Apply(engineQuery, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return d.resolveAnswerTarget(state, resp, req, question, engineQuery, metadata, depth), nil
 }
 
-// Build response message for server message
-func (d *DNSProxy) buildResponseMsg(clientRequest *dns.Msg, upstreamReply *dns.Msg) *dns.Msg {
-	respMsg := new(dns.Msg)
-	respMsg.SetReply(clientRequest)
+// Record the audit verdict in the access log and the metrics
+func (d *DNSProxy) logAudit(engine Engine, resp dns.ResponseWriter, question dns.Question, audit *AuditVerdict) {
+	if globalConfig.AccessLog {
+		d.accessLog.Infof(
+			"%s: %s AUDIT BLOCKED - Record %s - Rule %s %s (%s)",
+			engine.Name(),
+			resp.RemoteAddr().String(),
+			question.String(),
+			audit.RuleType,
+			audit.RuleID,
+			audit.Rule,
+		)
+	}
+	if globalConfig.Telemetry.Enabled {
+		metrics.IncrCounterWithLabels([]string{"hoopoe", "audit_blocked"}, 1, []metrics.Label{
+			{
+				Name:  "rule_id",
+				Value: audit.RuleID,
+			},
+			{
+				Name:  "type",
+				Value: audit.RuleType,
+			},
+		})
+	}
+}
+
+/*
+	Resolve the target of local CNAME record without local records, or of CNAME target rewritten by TARGET rule
+	The target is processed as a query of the client, so Deny and Allow rules block the whole answer
+	and the target is rewritten as any other query.
+*/
+func (d *DNSProxy) resolveAnswerTarget(state *proxyState, resp dns.ResponseWriter, req *dns.Msg, question dns.Question, answer *EngineQuery, metadata RequestMetadata, depth int) *EngineQuery {
+	if answer == nil || answer.Target == "" {
+		return answer
+	}
+	if depth >= MaxTargetDepth {
+		log.Warnf("CNAME targets of %s are not resolved, more than %d targets", question.Name, MaxTargetDepth)
+		return answer
+	}
 
-	if upstreamReply != nil {
-		// Set the original name in the response
-		for index, q := range clientRequest.Question {
-			upstreamReply.Answer[index].Header().Name = q.Name
+	target := dns.Question{Name: answer.Target, Qtype: question.Qtype, Qclass: question.Qclass}
+	reply, err := d.processMsg(state, resp, req, target, metadata, depth+1)
+	if err != nil {
+		handleError(err, 131)
+		return answer
+	}
+	if reply == nil || reply.Result == BLOCKED {
+		return reply
+	}
+	if reply.dnsMsg == nil {
+		return answer
+	}
+
+	// Records of the rewritten target are renamed back to the CNAME target
+	forEachRecord(reply.dnsMsg, func(rr dns.RR) {
+		if strings.EqualFold(rr.Header().Name, reply.Queries[0].Name) {
+			rr.Header().Name = answer.Target
 		}
-		respMsg.Answer = upstreamReply.Answer
+	})
+	msg := answer.dnsMsg
+	msg.Rcode = reply.dnsMsg.Rcode
+	msg.Answer = append(msg.Answer, reply.dnsMsg.Answer...)
+	msg.Ns = append(msg.Ns, reply.dnsMsg.Ns...)
+	return answer
+}
+
+/*
+	Resolve the block page host of the cname block mode, the records of the host are added after the CNAME record
+	The host is resolved by the upstream servers without the rules, so the block page is resolved even when its domain is blocked.
+*/
+func (d *DNSProxy) resolveBlockTarget(state *proxyState, respMsg *dns.Msg, req *dns.Msg, question dns.Question, block *BlockResponse, metadata RequestMetadata) {
+	if block.Mode != BlockCNAME || question.Qtype == dns.TypeCNAME {
+		return
 	}
 
-	return respMsg
+	query := &EngineQuery{dnsMsg: req}
+	query.Queries = append(query.Queries, Query{Name: block.Target, Type: question.Qtype, Class: question.Qclass})
+	reply, err := state.usManager.Apply(query, metadata)
+	if err != nil {
+		handleError(err, 132)
+		return
+	}
+	if reply.dnsMsg != nil {
+		respMsg.Answer = append(respMsg.Answer, reply.dnsMsg.Answer...)
+	}
 }
 
-// Build and send REFUSED response message to client
-func (d *DNSProxy) returnBlocked(resp dns.ResponseWriter, req *dns.Msg) {
-	respMsg := new(dns.Msg)
-	respMsg.SetReply(req)
-	respMsg.Rcode = dns.RcodeRefused
-	err := resp.WriteMsg(respMsg)
-	handleError(err, 205)
+// Merge the upstream reply of single question into the response message
+func (d *DNSProxy) mergeResponseMsg(respMsg *dns.Msg, req *dns.Msg, question dns.Question, reply *EngineQuery, first bool) {
+	upstreamReply := reply.dnsMsg
+	if upstreamReply == nil {
+		return
+	}
+
+	// Set the original name in the response instead of the rewritten name
+	forEachRecord(upstreamReply, func(rr dns.RR) {
+		for _, q := range reply.Queries {
+			if strings.EqualFold(rr.Header().Name, q.Name) {
+				rr.Header().Name = question.Name
+				break
+			}
+		}
+	})
+	mergeUpstreamMsg(respMsg, req, upstreamReply, first)
 }
 
-// handle PTR records
-// Currently PTR records rulesEngine are not supported
-func (d *DNSProxy) handlePtr(resp dns.ResponseWriter, req *dns.Msg) {
-	// Build new DNS message
-	upstreamMsg := new(dns.Msg)
-	req.CopyTo(upstreamMsg)
+/*
+	Copy the rcode, flags and all sections of the upstream reply into the response message
+	With multiple questions AD is set only when all the replies are authenticated,
+	and only for clients that asked for it by the DO or AD bits.
+	The OPT record of the upstream is not returned, the OPT of the response is built from the request.
+*/
+func mergeUpstreamMsg(respMsg *dns.Msg, req *dns.Msg, upstreamReply *dns.Msg, first bool) {
+	mergeRcode(respMsg, upstreamReply.Rcode)
+	respMsg.AuthenticatedData = upstreamReply.AuthenticatedData && (first || respMsg.AuthenticatedData) && wantsAuthenticatedData(req)
+	respMsg.RecursionAvailable = respMsg.RecursionAvailable || upstreamReply.RecursionAvailable
+	respMsg.Truncated = respMsg.Truncated || upstreamReply.Truncated
+
+	respMsg.Answer = append(respMsg.Answer, upstreamReply.Answer...)
+	respMsg.Ns = append(respMsg.Ns, upstreamReply.Ns...)
+	for _, rr := range upstreamReply.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			respMsg.Extra = append(respMsg.Extra, rr)
+		}
+	}
+}
 
-	metadata := RequestMetadata{
-		Region: d.regionMap.GetRegion(strings.Split(resp.RemoteAddr().String(), ":")[0]),
-		IPAddress: resp.RemoteAddr().String(),
+// Check if the client asked for the AD bit by setting DO or AD in the request
+func wantsAuthenticatedData(req *dns.Msg) bool {
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		return true
 	}
+	return req.AuthenticatedData
+}
 
-	// Send it to the upstream server
-	reply := d.usManager.forwardRequest(upstreamMsg, metadata)
+/*
+	Add the OPT record of the response to EDNS clients
+	Only the DO bit of the request is kept, options of the upstream servers like cookies and ECS are not returned.
+*/
+func setResponseEdns(respMsg *dns.Msg, req *dns.Msg) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+	respMsg.SetEdns0(dns.DefaultMsgSize, opt.Do())
+}
 
-	// Build response and send it
-	respMsg := new(dns.Msg)
-	respMsg.SetReply(req)
-	respMsg.Answer = reply.Answer
-	err := resp.WriteMsg(respMsg)
-	handleError(err, 111)
-}
\ No newline at end of file
+// Set the rcode of the response, the first failure of multiple questions is kept
+func mergeRcode(respMsg *dns.Msg, rcode int) {
+	if respMsg.Rcode == dns.RcodeSuccess {
+		respMsg.Rcode = rcode
+	}
+}
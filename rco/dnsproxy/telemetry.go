@@ -1,6 +1,8 @@
 package dnsproxy
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/armon/go-metrics"
 	prommetrics "github.com/armon/go-metrics/prometheus"
@@ -17,6 +19,8 @@ type TelemetryConfig struct {
 
 type TelemetryServer struct {
 	config  *TelemetryConfig
+	server  *http.Server
+	rules   func() []RuleStatus
 }
 
 func NewTelemetryServer(conf *TelemetryConfig) *TelemetryServer {
@@ -36,18 +40,35 @@ func (s *TelemetryServer) Init() {
 	_, _ = metrics.NewGlobal(metricsConfig, sink)
 	log.Info("Metrics: enabled.")
 
-	http.HandleFunc("/", s.handleRoot)
-	http.HandleFunc("/metrics", s.handleMetrics)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleRoot)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/rules", s.handleRules)
+	s.server = &http.Server{Addr: s.config.Address, Handler: mux}
+}
+
+// Set the source of the rule hits, exposed as metrics and by the rules endpoint
+func (s *TelemetryServer) SetRulesStatus(status func() []RuleStatus) {
+	s.rules = status
+	handleError(prometheus.Register(&ruleCollector{status: status}), 58)
 }
 
 func (s *TelemetryServer) ListenAndServe() {
 	if globalConfig.Telemetry.Enabled {
-		if err := http.ListenAndServe(s.config.Address, nil); err != nil {
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			handleError(err, 26)
 		}
 	}
 }
 
+// Stop the telemetry server, waiting for active requests until the context is done
+func (s *TelemetryServer) Shutdown(ctx context.Context) error {
+	if !globalConfig.Telemetry.Enabled {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
+}
+
 func (s *TelemetryServer) handleRoot(resp http.ResponseWriter, req *http.Request)  {
 	_, _ = fmt.Fprintf(resp, "<h1><span style=\"vertical-align: middle;\">Hoopoe</span></h1>")
 }
@@ -60,4 +81,17 @@ func (s *TelemetryServer) handleMetrics(resp http.ResponseWriter, req *http.Requ
 
 	handler := promhttp.HandlerFor(prometheus.DefaultGatherer, handlerOptions)
 	handler.ServeHTTP(resp, req)
-}
\ No newline at end of file
+}
+
+// Return the hits of all the rules as JSON
+func (s *TelemetryServer) handleRules(resp http.ResponseWriter, req *http.Request) {
+	if s.rules == nil {
+		http.Error(resp, "rules are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(resp)
+	encoder.SetIndent("", "  ")
+	handleError(encoder.Encode(s.rules()), 93)
+}
@@ -8,6 +8,7 @@ import (
 
 const (
 	ExprLeftover = `(^\.|^-|\.-|-\.|\.\.|--|-$)`
+	RegionTemplate = "{REGION}"
 )
 
 type TemplateEngine struct {
@@ -43,7 +44,7 @@ func (te *TemplateEngine) Apply(query *EngineQuery, metadata RequestMetadata) (*
 		name = te.templateLeftoverRegex.ReplaceAllString(name, "")
 	} else {
 		// Replace all region templates with the client region
-		name = strings.Replace(name, "{REGION}", metadata.Region, 0)
+		name = replaceFold(name, RegionTemplate, metadata.Region, -1)
 	}
 
 	// Check if the query still contains any template chars ({,})
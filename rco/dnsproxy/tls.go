@@ -0,0 +1,37 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+type TLSListenerConfig struct {
+	Port     int    `mapstructure:"Port"`
+	CertFile string `mapstructure:"CertFile"`
+	KeyFile  string `mapstructure:"KeyFile"`
+	Enabled  bool
+}
+
+// Build the listening address of the TLS listener from the host of the plain listener
+func (c *TLSListenerConfig) ListenAddress(localAddress string) string {
+	host, _, err := net.SplitHostPort(localAddress)
+	if err != nil {
+		host = localAddress
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.Port))
+}
+
+// Load the server certificate and build TLS config for listener
+func NewServerTLSConfig(certFile string, keyFile string) (error, *tls.Config) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %s", certFile, err), nil
+	}
+
+	return nil, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
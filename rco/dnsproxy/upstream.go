@@ -2,9 +2,11 @@ package dnsproxy
 
 import (
 	"errors"
+	"fmt"
 	"github.com/armon/go-metrics"
 	"github.com/miekg/dns"
 	"github.com/prometheus/common/log"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,8 +18,13 @@ const (
 )
 
 type UpstreamServer struct {
-	Address     string            `mapstructure:"Address"`
-	Annotations map[string]string `mapstructure:"Annotations"`
+	Address       string            `mapstructure:"Address"`
+	Annotations   map[string]string `mapstructure:"Annotations"`
+	TLSServerName string            `mapstructure:"TLSServerName"`
+	CAFile        string            `mapstructure:"CAFile"`
+	PinSHA256     []string          `mapstructure:"PinSHA256"`
+
+	transport Transport
 }
 
 type ServersView []*UpstreamServer
@@ -29,6 +36,8 @@ type UpstreamsManager struct {
 	rrLB             *IndexRoundRobin
 	regionMap        *RegionMap
 	serversRegionMap map[string]ServersView
+	policies         map[string]*upstreamPolicy
+	cache            *ResponseCache
 
 	Timeout time.Duration
 }
@@ -37,14 +46,15 @@ func NewServerView(size uint) ServersView {
 	return make([]*UpstreamServer, size)
 }
 
-func NewUpstreamsManager(servers []UpstreamServer, lbType string, regionMap *RegionMap, timeout string) *UpstreamsManager {
+func NewUpstreamsManager(servers []UpstreamServer, policies map[string]UpstreamPolicy, lbType string, regionMap *RegionMap, timeout string) (error, *UpstreamsManager) {
 	usm := new(UpstreamsManager)
 	usm.serversRegionMap = make(map[string]ServersView)
-	usm.Servers = servers
+	usm.policies = make(map[string]*upstreamPolicy)
+	usm.Servers = append([]UpstreamServer(nil), servers...)
 	var err error
 	usm.Timeout, err = time.ParseDuration(timeout)
 	if err != nil {
-		log.Fatal("Failed to parse Timeout")
+		return fmt.Errorf("failed to parse Timeout: %s", err), nil
 	}
 	if lbType == "RoundRobin" {
 		usm.LBType = RoundRobinLB
@@ -57,8 +67,24 @@ func NewUpstreamsManager(servers []UpstreamServer, lbType string, regionMap *Reg
 	}
 	usm.regionMap = regionMap
 
+	// Group names are case insensitive since config keys are lower cased
+	for group, conf := range policies {
+		err, policy := newUpstreamPolicy(conf)
+		if err != nil {
+			return fmt.Errorf("invalid upstream policy of %s: %s", group, err), nil
+		}
+		usm.policies[strings.ToLower(group)] = policy
+	}
+	if _, ok := usm.policies[AllGroupName]; !ok {
+		_, usm.policies[AllGroupName] = newUpstreamPolicy(UpstreamPolicy{})
+	}
+
 	for i, _:= range usm.Servers {
 		srv := &(usm.Servers[i])
+		if err, srv.transport = NewTransport(srv, usm.Timeout); err != nil {
+			usm.Close()
+			return fmt.Errorf("failed to build upstream %s transport: %s", srv.Address, err), nil
+		}
 		if region, ok := srv.Annotations["region"]; ok {
 			usm.serversRegionMap[region] = append(usm.serversRegionMap[region], srv)
 		}
@@ -66,13 +92,27 @@ func NewUpstreamsManager(servers []UpstreamServer, lbType string, regionMap *Reg
 		usm.serversRegionMap[AllGroupName] = append(usm.serversRegionMap[AllGroupName], srv)
 	}
 
-	return usm
+	return nil, usm
 }
 
 func (usm *UpstreamsManager) Name() string {
 	return "UpstreamManager"
 }
 
+// Set cache for the upstream responses, nil disables caching
+func (usm *UpstreamsManager) SetCache(cache *ResponseCache) {
+	usm.cache = cache
+}
+
+// Close the connections of all upstream servers
+func (usm *UpstreamsManager) Close() {
+	for i := range usm.Servers {
+		if usm.Servers[i].transport != nil {
+			handleError(usm.Servers[i].transport.Close(), 87)
+		}
+	}
+}
+
 func (usm *UpstreamsManager) Apply(query *EngineQuery, metadata RequestMetadata) (*EngineQuery, error) {
 	result := new(EngineQuery)
 	result.Queries = query.Queries
@@ -84,9 +124,27 @@ func (usm *UpstreamsManager) Apply(query *EngineQuery, metadata RequestMetadata)
 	// First query is the original after rewrites
 	// Second and later are fallback rules
 	for _, q := range query.Queries {
+		// Look for the response in cache before forwarding it
+		var cacheKey string
+		if usm.cache != nil {
+			cacheKey = CacheKey(q, metadata.Region, query.dnsMsg)
+			if resp := usm.cache.Get(cacheKey); resp != nil {
+				resp.Id = query.dnsMsg.Id
+				return &EngineQuery{
+					Queries: query.Queries,
+					Result:  ALLOWED,
+					dnsMsg:  resp,
+				}, nil
+			}
+		}
+
 		// Build upstream message and forward to Upstream Servers
 		upsRequest := usm.buildUpstreamMsg(query.dnsMsg, q)
-		resp := usm.forwardRequest(upsRequest, metadata)
+		resp, final := usm.forwardRequest(upsRequest, metadata)
+		// Replies of failed over servers may be replaced by the next server, they are not cached
+		if final && usm.cache != nil {
+			usm.cache.Set(cacheKey, resp)
+		}
 
 		// If response is not valid continue to next fallback query
 		if resp != nil {
@@ -108,32 +166,39 @@ func (usm *UpstreamsManager) buildUpstreamMsg(originReq *dns.Msg, query Query) *
 	upstreamMsg.Question[0] = dns.Question{
 		Name:   query.Name,
 		Qtype:  query.Type,
-		Qclass: originReq.Question[0].Qclass,
+		Qclass: query.Class,
 	}
 	return upstreamMsg
 }
 
-// Internal function of passing requests to the upstream DNS server
-func (usm *UpstreamsManager) forwardRequest(req *dns.Msg, meta RequestMetadata) *dns.Msg {
+/*
+	Internal function of passing requests to the upstream DNS server
+	Every server of the group is tried once until one returns a final reply by the group policy,
+	when none did the last reply is returned. Returns if the reply is final.
+*/
+func (usm *UpstreamsManager) forwardRequest(req *dns.Msg, meta RequestMetadata) (*dns.Msg, bool) {
 	startTime := time.Now()
-	// Create a DNS client
-	client := new(dns.Client)
 
 	// Make a request to the upstream server
+	var remote *UpstreamServer
 	var remoteHost string
-	err, servers := usm.UpstreamSelector(req, meta)
-	if err != nil {
-		return nil
+	// Last reply that is not final, returned when no server replied with final one
+	var lastResp *dns.Msg
+	group := usm.selectGroup(meta)
+	servers := usm.serversRegionMap[group]
+	if len(servers) == 0 {
+		return nil, false
 	}
+	policy := usm.groupPolicy(group)
 
-	currentTime := time.Now()
-	for i :=0; currentTime.Before(startTime.Add(usm.Timeout)); i++ {
-		if usm.LBType == RoundRobinLB {
-			remoteHost = servers[usm.rrLB.LimitedGet(len(servers))].Address
-		} else {
-			remoteHost = servers[i].Address
-		}
-		resp, _, err := client.Exchange(req, remoteHost)
+	first := 0
+	if usm.LBType == RoundRobinLB {
+		first = usm.rrLB.LimitedGet(len(servers))
+	}
+	for i := 0; i < len(servers) && time.Since(startTime) < usm.Timeout; i++ {
+		remote = servers[(first+i)%len(servers)]
+		remoteHost = remote.Address
+		resp, err := remote.transport.Exchange(req)
 		if globalConfig.Telemetry.Enabled {
 			metrics.IncrCounterWithLabels([]string{"hoopoe", "request_count"}, 1, []metrics.Label{
 				{
@@ -153,32 +218,42 @@ func (usm *UpstreamsManager) forwardRequest(req *dns.Msg, meta RequestMetadata)
 				})
 			}
 			log.Warnf("Error while contacting server: %s, message: %s", remoteHost, err)
-		} else if len(resp.Answer) > 0 {
-			return resp
+		} else if policy.isFinal(resp) {
+			return resp, true
+		} else {
+			log.Debugf("Failing over from server: %s, rcode: %s", remoteHost, dns.RcodeToString[resp.Rcode])
+			lastResp = resp
 		}
-		currentTime = time.Now()
 	}
 
-	return nil
+	return lastResp, false
 }
 
 // Get Matching Upstream Servers
 func (usm *UpstreamsManager) UpstreamSelector(req *dns.Msg, meta RequestMetadata) (error, ServersView) {
+	return nil, usm.serversRegionMap[usm.selectGroup(meta)]
+}
+
+// Get the upstream group of the client region, fallback to "all" group
+func (usm *UpstreamsManager) selectGroup(meta RequestMetadata) string {
 	// Skip region checking if region map do not exists
 	if usm.regionMap == nil {
-		goto allServers
+		return AllGroupName
 	}
 
 	// Get regional upstream servers
-	if serversList, ok := usm.serversRegionMap[meta.Region]; ok {
-		return nil, serversList
-	} else {
-		// Fallback to All server group
-		goto allServers
+	if _, ok := usm.serversRegionMap[meta.Region]; ok {
+		return meta.Region
 	}
+	return AllGroupName
+}
 
-	allServers:
-		return nil, usm.serversRegionMap[AllGroupName]
+// Get the policy of the group, fallback to "all" group policy
+func (usm *UpstreamsManager) groupPolicy(group string) *upstreamPolicy {
+	if policy, ok := usm.policies[strings.ToLower(group)]; ok {
+		return policy
+	}
+	return usm.policies[AllGroupName]
 }
 
 type IndexRoundRobin struct {
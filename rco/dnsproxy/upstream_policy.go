@@ -0,0 +1,59 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+var (
+	// Rcodes returned to the client without trying the next upstream server
+	DefaultFinalRcodes = []string{"NOERROR", "NXDOMAIN"}
+)
+
+// Failover policy of upstream group, configured by region name or "all"
+type UpstreamPolicy struct {
+	FinalRcodes     []string `mapstructure:"FinalRcodes"`
+	FailoverOnEmpty bool     `mapstructure:"FailoverOnEmpty"`
+}
+
+type upstreamPolicy struct {
+	finalRcodes     map[int]bool
+	failoverOnEmpty bool
+}
+
+func newUpstreamPolicy(conf UpstreamPolicy) (error, *upstreamPolicy) {
+	policy := &upstreamPolicy{
+		finalRcodes:     make(map[int]bool),
+		failoverOnEmpty: conf.FailoverOnEmpty,
+	}
+
+	rcodes := conf.FinalRcodes
+	if len(rcodes) == 0 {
+		rcodes = DefaultFinalRcodes
+	}
+	for _, name := range rcodes {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(name)]
+		if !ok {
+			return fmt.Errorf("unknown rcode %s", name), nil
+		}
+		policy.finalRcodes[rcode] = true
+	}
+
+	return nil, policy
+}
+
+/*
+	Check if the reply is final and should be returned to the client
+	Replies that are not final are failing over to the next upstream server.
+	NOERROR replies without answers (NODATA) are final unless FailoverOnEmpty is set.
+*/
+func (p *upstreamPolicy) isFinal(resp *dns.Msg) bool {
+	if !p.finalRcodes[resp.Rcode] {
+		return false
+	}
+	if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0 {
+		return !p.failoverOnEmpty
+	}
+	return true
+}
@@ -0,0 +1,302 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	UDPScheme   = "udp"
+	TCPScheme   = "tcp"
+	TLSScheme   = "tls"
+	HTTPSScheme = "https"
+
+	DNSDefaultPort = "53"
+	DoTDefaultPort = "853"
+
+	// Max idle connections kept open for every stream upstream
+	MaxIdleConns = 8
+)
+
+// Transport used to exchange messages with single upstream server
+type Transport interface {
+	Exchange(*dns.Msg) (*dns.Msg, error)
+	Close() error
+}
+
+/*
+	Build the transport of upstream server by the address scheme
+	Supported address formats:
+	host:port, udp://host:port, tcp://host:port, tls://host:port, https://host/path
+*/
+func NewTransport(srv *UpstreamServer, timeout time.Duration) (error, Transport) {
+	if !strings.Contains(srv.Address, "://") {
+		return nil, newUDPTransport(withDefaultPort(srv.Address, DNSDefaultPort), timeout)
+	}
+
+	u, err := url.Parse(srv.Address)
+	if err != nil {
+		return fmt.Errorf("invalid upstream address %s: %s", srv.Address, err), nil
+	}
+
+	switch u.Scheme {
+	case UDPScheme:
+		return nil, newUDPTransport(withDefaultPort(u.Host, DNSDefaultPort), timeout)
+	case TCPScheme:
+		return nil, newStreamTransport(withDefaultPort(u.Host, DNSDefaultPort), "tcp", nil, timeout)
+	case TLSScheme:
+		err, tlsConfig := newUpstreamTLSConfig(srv, u.Hostname())
+		if err != nil {
+			return err, nil
+		}
+		return nil, newStreamTransport(withDefaultPort(u.Host, DoTDefaultPort), "tcp-tls", tlsConfig, timeout)
+	case HTTPSScheme:
+		err, tlsConfig := newUpstreamTLSConfig(srv, u.Hostname())
+		if err != nil {
+			return err, nil
+		}
+		return nil, newHTTPSTransport(u.String(), tlsConfig, timeout)
+	default:
+		return fmt.Errorf("unsupported upstream scheme %s in %s", u.Scheme, srv.Address), nil
+	}
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	return host
+}
+
+// Build TLS config with server name, CA bundle and certificate pinning of the upstream
+func newUpstreamTLSConfig(srv *UpstreamServer, host string) (error, *tls.Config) {
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if srv.TLSServerName != "" {
+		tlsConfig.ServerName = srv.TLSServerName
+	}
+
+	if srv.CAFile != "" {
+		data, err := ioutil.ReadFile(srv.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file %s: %s", srv.CAFile, err), nil
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in CA file %s", srv.CAFile), nil
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(srv.PinSHA256) > 0 {
+		var pins [][]byte
+		for _, pin := range srv.PinSHA256 {
+			decoded, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(decoded) != sha256.Size {
+				return fmt.Errorf("invalid SHA256 pin %s for upstream %s", pin, srv.Address), nil
+			}
+			pins = append(pins, decoded)
+		}
+		tlsConfig.VerifyPeerCertificate = pinVerifier(pins)
+	}
+
+	return nil, tlsConfig
+}
+
+// Verify that one of the certificates in the chain has public key matching one of the pins
+func pinVerifier(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+		}
+		return errors.New("upstream certificate does not match any pinned public key")
+	}
+}
+
+// Plain DNS over UDP, truncated responses are retried over TCP
+type udpTransport struct {
+	address   string
+	client    *dns.Client
+	tcpClient *dns.Client
+}
+
+func newUDPTransport(address string, timeout time.Duration) *udpTransport {
+	return &udpTransport{
+		address:   address,
+		client:    &dns.Client{UDPSize: dns.DefaultMsgSize, Timeout: timeout},
+		tcpClient: &dns.Client{Net: "tcp", Timeout: timeout},
+	}
+}
+
+func (t *udpTransport) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := t.client.Exchange(req, t.address)
+	if err == nil && resp.Truncated {
+		resp, _, err = t.tcpClient.Exchange(req, t.address)
+	}
+	return resp, err
+}
+
+func (t *udpTransport) Close() error {
+	return nil
+}
+
+// DNS over TCP or TLS, connections are kept open and reused across queries
+type streamTransport struct {
+	sync.Mutex
+
+	address string
+	client  *dns.Client
+	idle    []*dns.Conn
+	closed  bool
+}
+
+func newStreamTransport(address string, network string, tlsConfig *tls.Config, timeout time.Duration) *streamTransport {
+	return &streamTransport{
+		address: address,
+		client:  &dns.Client{Net: network, TLSConfig: tlsConfig, Timeout: timeout},
+	}
+}
+
+func (t *streamTransport) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	conn, reused, err := t.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := t.client.ExchangeWithConn(req, conn)
+	// Idle connection may be closed by the server, retry once on a new connection
+	if err != nil && reused {
+		_ = conn.Close()
+		if conn, err = t.client.Dial(t.address); err != nil {
+			return nil, err
+		}
+		resp, _, err = t.client.ExchangeWithConn(req, conn)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	t.putConn(conn)
+	return resp, nil
+}
+
+func (t *streamTransport) getConn() (*dns.Conn, bool, error) {
+	t.Lock()
+	if n := len(t.idle); n > 0 {
+		conn := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		t.Unlock()
+		return conn, true, nil
+	}
+	t.Unlock()
+
+	conn, err := t.client.Dial(t.address)
+	return conn, false, err
+}
+
+func (t *streamTransport) putConn(conn *dns.Conn) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed || len(t.idle) >= MaxIdleConns {
+		_ = conn.Close()
+		return
+	}
+	t.idle = append(t.idle, conn)
+}
+
+func (t *streamTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.closed = true
+	for _, conn := range t.idle {
+		_ = conn.Close()
+	}
+	t.idle = nil
+	return nil
+}
+
+// DNS over HTTPS (RFC 8484), the HTTP client keeps the connections alive
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSTransport(url string, tlsConfig *tls.Config, timeout time.Duration) *httpsTransport {
+	return &httpsTransport{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     tlsConfig,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: MaxIdleConns,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+	}
+}
+
+func (t *httpsTransport) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends using ID 0 for better HTTP caching
+	id := req.Id
+	req.Id = 0
+	data, err := req.Pack()
+	req.Id = id
+	if err != nil {
+		return nil, err
+	}
+
+	httpResp, err := t.client.Post(t.url, DoHContentType, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned HTTP status %s", httpResp.Status)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, httpResp.Body, DoHMaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err = resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	resp.Id = id
+	return resp, nil
+}
+
+func (t *httpsTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
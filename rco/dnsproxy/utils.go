@@ -1,19 +1,30 @@
 package dnsproxy
 
-import "regexp"
+import (
+	"regexp"
+	"strings"
+)
 
 const (
 	DnsQueryExpr = `^(([a-zA-Z0-9]|[a-zA-Z0-9\-\{\}]*[a-zA-Z0-9\{\}])\.)*([A-Za-z0-9\{\}]|[A-Za-z0-9\-\{\}]*[A-Za-z0-9\{\}])$`
+	// Part of a name, labels may be cut at the edges of the pattern
+	DnsPatternExpr = `^\.?([A-Za-z0-9_\-\{\}]+\.)*[A-Za-z0-9_\-\{\}]*$`
 )
 
 var (
 	DnsValidator = regexp.MustCompile(DnsQueryExpr)
+	DnsPatternValidator = regexp.MustCompile(DnsPatternExpr)
 )
 
 func ValidateDNSFormat(dnsName string) bool {
 	return DnsValidator.MatchString(dnsName)
 }
 
+// Validate name pattern of the rules, the pattern may start or end inside a label
+func ValidateDNSPattern(pattern string) bool {
+	return strings.Trim(pattern, ".") != "" && DnsPatternValidator.MatchString(pattern)
+}
+
 func ValidateTemplateBrackets(pattern string) bool {
 	openBr := false
 	// Run on each char
@@ -37,3 +48,73 @@ func ValidateTemplateBrackets(pattern string) bool {
 	}
 	return !openBr
 }
+
+// Case insensitive strings.HasPrefix, DNS names are compared case insensitive (RFC 4343)
+func hasPrefixFold(s string, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// Case insensitive strings.HasSuffix
+func hasSuffixFold(s string, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// Case insensitive strings.Index
+func indexFold(s string, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Case insensitive strings.LastIndex
+func lastIndexFold(s string, substr string) int {
+	for i := len(s) - len(substr); i >= 0; i-- {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Case insensitive strings.Replace, the case of the parts that are not replaced is kept
+func replaceFold(s string, old string, new string, n int) string {
+	if old == "" || n == 0 {
+		return s
+	}
+
+	var result strings.Builder
+	for n != 0 {
+		i := indexFold(s, old)
+		if i < 0 {
+			break
+		}
+		result.WriteString(s[:i])
+		result.WriteString(new)
+		s = s[i+len(old):]
+		n--
+	}
+	result.WriteString(s)
+	return result.String()
+}
+
+// replaceFold starting from the end of s, the last n occurrences are replaced
+func replaceFoldRight(s string, old string, new string, n int) string {
+	if old == "" || n == 0 {
+		return s
+	}
+
+	result := ""
+	for n != 0 {
+		i := lastIndexFold(s, old)
+		if i < 0 {
+			break
+		}
+		result = new + s[i+len(old):] + result
+		s = s[:i]
+		n--
+	}
+	return s + result
+}